@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
-	"github.com/mattmac4241/chat-auth/service"
+	"github.com/mattmac4241/chat-friends/service"
 )
 
 func main() {
@@ -15,13 +22,80 @@ func main() {
 		log.Fatal("Error loading .env file")
 	}
 
-	dburl := os.Getenv("DBURL")
+	config, err := service.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	migrating := len(os.Args) > 1 && os.Args[1] == "migrate"
+	if migrating && config.Backend == service.BackendMemory {
+		log.Fatalf("The %s backend has no schema to migrate, set DB_BACKEND to migrate a database", config.Backend)
+	}
+
+	if config.Backend != service.BackendMemory {
+		db := connectSQL(config)
+		if migrating {
+			if err := migrate(db, config.Backend, os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		if err := service.CheckSchemaVersion(db, config.Backend); err != nil {
+			log.Fatal(err)
+		}
+		connectRedis()
+	} else {
+		log.Printf("Using the %s backend, nothing is persisted", config.Backend)
+	}
+
+	port := os.Getenv("PORT")
+	if len(port) == 0 {
+		port = "3001"
+	}
+	server := service.NewServer(config)
+	httpServer := &http.Server{Addr: ":" + port, Handler: server}
+
+	go func() {
+		log.Printf("Listening on :%s", port)
+		err := httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down cleanly: %v", err)
+	}
+	server.Close()
+}
 
-	dbinfo := fmt.Sprintf("%s", dburl)
-	db, err := service.InitDatabase(dbinfo)
+// connectSQL opens the database the Postgres or SQLite backend uses.
+func connectSQL(config service.Config) *sql.DB {
+	var db *sql.DB
+	var err error
+	if config.Backend == service.BackendSQLite {
+		db, err = service.InitSQLite(config.SQLitePath)
+	} else {
+		dburl := os.Getenv("DBURL")
+
+		dbinfo := fmt.Sprintf("%s", dburl)
+		db, err = service.InitDatabase(dbinfo)
+	}
 	if err != nil {
 		log.Fatal("Failed to connect to database")
 	}
+	service.DB = db
+	return db
+}
+
+// connectRedis connects to the Redis holding the auth tokens.
+func connectRedis() {
 	redisAddress := os.Getenv("REDIS_ADDRESS")
 	redisPassword := os.Getenv("REDIS_PASSWORD")
 
@@ -29,14 +103,53 @@ func main() {
 	if err != nil {
 		log.Fatal("Failed to connect to redis")
 	}
-
 	service.REDIS = redis
-	service.DB = db
+}
 
-	port := os.Getenv("PORT")
-	if len(port) == 0 {
-		port = "3001"
+// migrate runs the migrate subcommand: "up" applies every pending migration,
+// "down [steps]" reverts the newest one, or steps of them, and "status" lists
+// them all.
+func migrate(db *sql.DB, backend string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s migrate up|down [steps]|status", os.Args[0])
+	}
+	switch args[0] {
+	case "up":
+		done, err := service.MigrateUp(db, backend)
+		for _, migration := range done {
+			log.Printf("Applied %d %s", migration.Version, migration.Name)
+		}
+		if err == nil && len(done) == 0 {
+			log.Printf("Already up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps <= 0 {
+				return fmt.Errorf("Invalid number of steps: %q", args[1])
+			}
+		}
+		done, err := service.MigrateDown(db, backend, steps)
+		for _, migration := range done {
+			log.Printf("Reverted %d %s", migration.Version, migration.Name)
+		}
+		return err
+	case "status":
+		states, err := service.MigrationStatus(db, backend)
+		if err != nil {
+			return err
+		}
+		for _, state := range states {
+			applied := "pending"
+			if state.Applied {
+				applied = "applied " + state.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-32s %s\n", state.Version, state.Name, applied)
+		}
+		return nil
 	}
-	server := service.NewServer()
-	server.Run(":" + port)
+	return fmt.Errorf("Unknown migrate command %q", args[0])
 }
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Reasons given with a can-message decision.
+const (
+	ReasonFriends             = "friends"
+	ReasonOpen                = "recipient_allows_everyone"
+	ReasonFriendsOfFriends    = "friends_of_friends"
+	ReasonNotFriendsOfFriends = "not_friends_of_friends"
+	ReasonNotFriends          = "not_friends"
+)
+
+//MessageDecision says whether one user may message another, and why
+type MessageDecision struct {
+	From    uint   `json:"from"`
+	To      uint   `json:"to"`
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+}
+
+// decideCanMessage works out whether from may message to. Blocks in either
+// direction always deny, friends are always allowed, and otherwise the
+// recipient's request settings decide who may reach them. A block is given
+// the same reason as any other denial, so the blocked user can't find out
+// about it.
+func decideCanMessage(ctx context.Context, from, to uint, database Database) (MessageDecision, error) {
+	decision := MessageDecision{From: from, To: to}
+
+	_, err := database.getBlockBetween(ctx, from, to)
+	if err == nil {
+		decision.Reason = ReasonNotFriends
+		return decision, nil
+	}
+	if err != sql.ErrNoRows {
+		return decision, err
+	}
+
+	request, err := getRequestBetween(ctx, from, to, database)
+	if err != nil && err != sql.ErrNoRows {
+		return decision, err
+	}
+	if err == nil && request.Status == StatusAccepted {
+		decision.Allowed, decision.Reason = true, ReasonFriends
+		return decision, nil
+	}
+
+	settings, err := getSettingsOrDefault(ctx, to, database)
+	if err != nil {
+		return decision, err
+	}
+	switch settings.AllowRequestsFrom {
+	case AllowEveryone:
+		decision.Allowed, decision.Reason = true, ReasonOpen
+	case AllowFriendsOfFriends:
+		mutual, err := haveMutualFriend(ctx, from, to, database)
+		if err != nil {
+			return decision, err
+		}
+		decision.Allowed = mutual
+		decision.Reason = ReasonNotFriendsOfFriends
+		if mutual {
+			decision.Reason = ReasonFriendsOfFriends
+		}
+	default:
+		decision.Reason = ReasonNotFriends
+	}
+	return decision, nil
+}
+
+// canMessage is decideCanMessage cached in redis for ttl. Cached decisions
+// are keyed by a generation per user, which decisionCache bumps whenever
+// something that goes into a decision involving that user changes.
+func canMessage(ctx context.Context, from, to uint, ttl time.Duration, database Database) (MessageDecision, error) {
+	key := decisionKey(ctx, from, to, database)
+	if cached, err := database.redisGetValue(ctx, key); err == nil && cached != "" {
+		var decision MessageDecision
+		if json.Unmarshal([]byte(cached), &decision) == nil {
+			return decision, nil
+		}
+	}
+
+	decision, err := decideCanMessage(ctx, from, to, database)
+	if err != nil {
+		return decision, err
+	}
+	if encoded, err := json.Marshal(decision); err == nil {
+		if err = database.redisSetValue(ctx, key, string(encoded), ttl); err != nil {
+			log.Printf("Failed to cache can-message decision: %v", err)
+		}
+	}
+	return decision, nil
+}
+
+func decisionKey(ctx context.Context, from, to uint, database Database) string {
+	return fmt.Sprintf("friends:can-message:%d:%d:%s:%s", from, to,
+		decisionGeneration(ctx, from, database), decisionGeneration(ctx, to, database))
+}
+
+func generationKey(userID uint) string {
+	return fmt.Sprintf("friends:can-message:generation:%d", userID)
+}
+
+func decisionGeneration(ctx context.Context, userID uint, database Database) string {
+	generation, err := database.redisGetValue(ctx, generationKey(userID))
+	if err != nil || generation == "" {
+		return "0"
+	}
+	return generation
+}
+
+// decisionCache invalidates cached can-message decisions as the data they
+// are made from changes.
+type decisionCache struct {
+	Database
+	ttl time.Duration
+}
+
+func withDecisionInvalidation(database Database, ttl time.Duration) Database {
+	return &decisionCache{Database: database, ttl: ttl}
+}
+
+// invalidate drops every cached decision to or from the given users. The
+// generation outlives the decisions cached under the previous one, so it
+// can't fall back to a generation that still has decisions cached. It runs
+// even when the request that made the change has been cancelled since, as the
+// change is already stored.
+func (d *decisionCache) invalidate(userIDs ...uint) {
+	generation := strconv.FormatInt(time.Now().UnixNano(), 10)
+	for _, userID := range userIDs {
+		err := d.Database.redisSetValue(context.Background(), generationKey(userID), generation, d.ttl)
+		if err != nil {
+			log.Printf("Failed to invalidate can-message decisions for %d: %v", userID, err)
+		}
+	}
+}
+
+func (d *decisionCache) insertFriendRequest(ctx context.Context, request FriendRequest) error {
+	err := d.Database.insertFriendRequest(ctx, request)
+	d.invalidate(request.UserFromID, request.UserToID)
+	return err
+}
+
+func (d *decisionCache) updateFriendRequest(ctx context.Context, request FriendRequest) error {
+	err := d.Database.updateFriendRequest(ctx, request)
+	d.invalidate(request.UserFromID, request.UserToID)
+	return err
+}
+
+func (d *decisionCache) insertBlock(ctx context.Context, block Block) error {
+	err := d.Database.insertBlock(ctx, block)
+	d.invalidate(block.UserID, block.BlockedUserID)
+	return err
+}
+
+func (d *decisionCache) deleteBlock(ctx context.Context, userID, blockedUserID uint) error {
+	err := d.Database.deleteBlock(ctx, userID, blockedUserID)
+	d.invalidate(userID, blockedUserID)
+	return err
+}
+
+func (d *decisionCache) upsertSettings(ctx context.Context, settings Settings) error {
+	err := d.Database.upsertSettings(ctx, settings)
+	d.invalidate(settings.UserID)
+	return err
+}
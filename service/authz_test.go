@@ -0,0 +1,163 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/urfave/negroni"
+)
+
+func TestDecideCanMessage(t *testing.T) {
+	database := newGraphTestDatabase()
+	database.upsertSettings(ctx, Settings{UserID: 5, AllowRequestsFrom: AllowFriendsOfFriends})
+	database.upsertSettings(ctx, Settings{UserID: 7, AllowRequestsFrom: AllowFriendsOfFriends})
+	database.upsertSettings(ctx, Settings{UserID: 8, AllowRequestsFrom: AllowNobody})
+	database.insertBlock(ctx, BlockUser(3, 2))
+
+	for _, test := range []struct {
+		from, to uint
+		allowed  bool
+		reason   string
+	}{
+		{1, 2, true, ReasonFriends},
+		{2, 3, false, ReasonNotFriends},
+		{3, 2, false, ReasonNotFriends},
+		{1, 6, true, ReasonOpen},
+		{1, 5, true, ReasonFriendsOfFriends},
+		{1, 7, false, ReasonNotFriendsOfFriends},
+		{1, 8, false, ReasonNotFriends},
+	} {
+		decision, err := decideCanMessage(ctx, test.from, test.to, database)
+		if err != nil {
+			t.Errorf("%d -> %d: unexpected error %v", test.from, test.to, err)
+			continue
+		}
+		if decision.Allowed != test.allowed || decision.Reason != test.reason {
+			t.Errorf("%d -> %d: expected %v (%s), got %+v", test.from, test.to,
+				test.allowed, test.reason, decision)
+		}
+	}
+}
+
+func makeCanMessageTestServer(database Database) *negroni.Negroni {
+	config := testConfig
+	config.ServiceTokens = []string{"CHAT"}
+	server := negroni.New()
+	mx := mux.NewRouter()
+	initRoutes(mx, formatter, withDecisionInvalidation(database, config.CanMessageCacheTTL), config)
+	server.UseHandler(mx)
+	return server
+}
+
+func getCanMessage(t *testing.T, server http.Handler, url string) MessageDecision {
+	var decision MessageDecision
+	recorder = serveTestRequest(server, "GET", url, "U1")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("%s: expected %v; received %v", url, http.StatusOK, recorder.Code)
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &decision)
+	return decision
+}
+
+func TestCanMessageHandlerCachesDecisions(t *testing.T) {
+	database := newGraphTestDatabase()
+	server := makeCanMessageTestServer(database)
+
+	if decision := getCanMessage(t, server, "/authz/can-message?from=1&to=6"); !decision.Allowed {
+		t.Fatalf("expected 1 to be able to message 6, got %+v", decision)
+	}
+
+	// Changes that don't go through the service aren't seen until the
+	// cached decision expires.
+	database.settings = map[uint]Settings{6: {UserID: 6, AllowRequestsFrom: AllowNobody}}
+	if decision := getCanMessage(t, server, "/authz/can-message?from=1&to=6"); !decision.Allowed {
+		t.Errorf("expected the cached decision, got %+v", decision)
+	}
+}
+
+func TestCanMessageHandlerInvalidatesDecisions(t *testing.T) {
+	database := newGraphTestDatabase()
+	server := makeCanMessageTestServer(database)
+	url := "/authz/can-message?from=1&to=6"
+
+	getCanMessage(t, server, url)
+	recorder = serveTestJSON(server, "POST", "/blocks", "U6", "{\"blocked_user_id\": 1}")
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected %v; received %v", http.StatusCreated, recorder.Code)
+	}
+	if decision := getCanMessage(t, server, url); decision.Allowed || decision.Reason != ReasonNotFriends {
+		t.Errorf("expected the block to deny messaging, got %+v", decision)
+	}
+
+	serveTestRequest(server, "DELETE", "/blocks/1", "U6")
+	if decision := getCanMessage(t, server, url); !decision.Allowed {
+		t.Errorf("expected the unblock to allow messaging, got %+v", decision)
+	}
+
+	recorder = serveTestJSON(server, "PUT", "/friends/settings", "U6",
+		"{\"allow_requests_from\": \"friends_of_friends\"}")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	if decision := getCanMessage(t, server, url); decision.Reason != ReasonFriendsOfFriends {
+		t.Errorf("expected the settings change to be seen, got %+v", decision)
+	}
+
+	// Unfriending 4 leaves 1 and 6 without a mutual friend.
+	serveTestRequest(server, "DELETE", "/friends/4", "U6")
+	if decision := getCanMessage(t, server, url); decision.Allowed {
+		t.Errorf("expected the unfriend to deny messaging, got %+v", decision)
+	}
+}
+
+func TestCanMessageHandlerAnswersServicesForAnyPair(t *testing.T) {
+	database := newGraphTestDatabase()
+	database.insertBlock(ctx, Block{UserID: 6, BlockedUserID: 4})
+	server := negroni.New(AuthMiddleware(database, []string{"CHAT"}))
+	server.UseHandler(makeCanMessageTestServer(database))
+
+	for url, expected := range map[string]MessageDecision{
+		"/authz/can-message?from=2&to=3": {From: 2, To: 3, Allowed: true, Reason: ReasonFriends},
+		"/authz/can-message?from=4&to=6": {From: 4, To: 6, Allowed: false, Reason: ReasonNotFriends},
+	} {
+		var decision MessageDecision
+		recorder = serveTestRequest(server, "GET", url, "CHAT")
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: expected %v; received %v", url, http.StatusOK, recorder.Code)
+		}
+		json.Unmarshal(recorder.Body.Bytes(), &decision)
+		if decision != expected {
+			t.Errorf("%s: expected %+v, got %+v", url, expected, decision)
+		}
+	}
+
+	// The service credential isn't a user, so it can't act as one.
+	recorder = serveTestRequest(server, "GET", "/friends", "CHAT")
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("expected %v; received %v", http.StatusForbidden, recorder.Code)
+	}
+}
+
+func TestCanMessageHandlerRejectsBadRequests(t *testing.T) {
+	server := makeCanMessageTestServer(newGraphTestDatabase())
+
+	for _, token := range []string{"", "U2", "U6"} {
+		recorder = serveTestRequest(server, "GET", "/authz/can-message?from=1&to=6", token)
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("%q: expected %v; received %v", token, http.StatusForbidden, recorder.Code)
+		}
+	}
+	for _, url := range []string{
+		"/authz/can-message",
+		"/authz/can-message?from=1",
+		"/authz/can-message?from=a&to=6",
+		"/authz/can-message?from=1&to=1",
+	} {
+		recorder = serveTestRequest(server, "GET", url, "U1")
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %v; received %v", url, http.StatusBadRequest, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage backends the service can run on.
+const (
+	BackendPostgres = "postgres"
+	BackendMemory   = "memory"
+	BackendSQLite   = "sqlite"
+)
+
+//Config holds the settings the service reads from the environment
+type Config struct {
+	// Backend is where friendships are stored, BackendPostgres,
+	// BackendSQLite or BackendMemory.
+	Backend string
+	// SQLitePath is the database file the SQLite backend uses.
+	SQLitePath string
+	// MemoryTokens seeds the memory backend with auth tokens and the users
+	// they belong to, as there is no Redis to look them up in.
+	MemoryTokens map[string]uint
+	// RequestTTL is how long a request may stay pending before it expires.
+	// Zero keeps pending requests forever.
+	RequestTTL time.Duration
+	// SweepInterval is how often expired requests are swept in the background.
+	SweepInterval time.Duration
+	// RejectionCooldown is how long a sender has to wait after a rejection
+	// before sending the same user another request.
+	RejectionCooldown time.Duration
+	// MaxPathDepth is the longest chain of friends the path search looks for.
+	MaxPathDepth int
+	// MaxPathVisited caps how many users a single path search may visit.
+	MaxPathVisited int
+	// CanMessageCacheTTL is how long can-message decisions are cached.
+	CanMessageCacheTTL time.Duration
+	// MaxFavorites caps how many friends a user may mark as favorites.
+	MaxFavorites int
+	// OperationTimeout is how long each database or Redis operation may take.
+	// Zero leaves operations to run as long as the request does.
+	OperationTimeout time.Duration
+	// ServiceTokens are the credentials other services, such as chat, use to
+	// ask whether any user may message another.
+	ServiceTokens []string
+}
+
+//DefaultConfig returns the settings used when nothing is configured
+func DefaultConfig() Config {
+	return Config{
+		Backend:            BackendPostgres,
+		SQLitePath:         "friends.db",
+		RequestTTL:         30 * 24 * time.Hour,
+		SweepInterval:      10 * time.Minute,
+		RejectionCooldown:  7 * 24 * time.Hour,
+		MaxPathDepth:       4,
+		MaxPathVisited:     10000,
+		CanMessageCacheTTL: 5 * time.Minute,
+		MaxFavorites:       20,
+		OperationTimeout:   5 * time.Second,
+	}
+}
+
+//LoadConfig reads the config from the environment, falling back to the
+//defaults for anything that isn't set
+func LoadConfig() (Config, error) {
+	config := DefaultConfig()
+	if backend := os.Getenv("DB_BACKEND"); backend != "" {
+		if backend != BackendPostgres && backend != BackendSQLite && backend != BackendMemory {
+			return config, fmt.Errorf("Invalid DB_BACKEND: %q", backend)
+		}
+		config.Backend = backend
+	}
+	if path := os.Getenv("SQLITE_PATH"); path != "" {
+		config.SQLitePath = path
+	}
+	if raw := os.Getenv("MEMORY_AUTH_TOKENS"); raw != "" {
+		tokens, err := parseTokens(raw)
+		if err != nil {
+			return config, fmt.Errorf("Invalid MEMORY_AUTH_TOKENS: %v", err)
+		}
+		config.MemoryTokens = tokens
+	}
+	for _, token := range strings.Split(os.Getenv("SERVICE_TOKENS"), ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			config.ServiceTokens = append(config.ServiceTokens, token)
+		}
+	}
+	durations := map[string]*time.Duration{
+		"REQUEST_TTL":            &config.RequestTTL,
+		"REQUEST_SWEEP_INTERVAL": &config.SweepInterval,
+		"REJECTION_COOLDOWN":     &config.RejectionCooldown,
+		"CAN_MESSAGE_CACHE_TTL":  &config.CanMessageCacheTTL,
+		"OPERATION_TIMEOUT":      &config.OperationTimeout,
+	}
+	for name, value := range durations {
+		if err := durationFromEnv(name, value); err != nil {
+			return config, err
+		}
+	}
+	ints := map[string]*int{
+		"PATH_MAX_DEPTH":   &config.MaxPathDepth,
+		"PATH_MAX_VISITED": &config.MaxPathVisited,
+		"MAX_FAVORITES":    &config.MaxFavorites,
+	}
+	for name, value := range ints {
+		if err := intFromEnv(name, value); err != nil {
+			return config, err
+		}
+	}
+	if config.SweepInterval <= 0 {
+		return config, fmt.Errorf("REQUEST_SWEEP_INTERVAL must be positive")
+	}
+	if config.CanMessageCacheTTL <= 0 {
+		return config, fmt.Errorf("CAN_MESSAGE_CACHE_TTL must be positive")
+	}
+	return config, nil
+}
+
+func durationFromEnv(name string, value *time.Duration) error {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return nil
+	}
+	duration, err := time.ParseDuration(raw)
+	if err != nil || duration < 0 {
+		return fmt.Errorf("Invalid %s: %q", name, raw)
+	}
+	*value = duration
+	return nil
+}
+
+func intFromEnv(name string, value *int) error {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return nil
+	}
+	parsed, err := strconv.Atoi(raw)
+	if err != nil || parsed <= 0 {
+		return fmt.Errorf("Invalid %s: %q", name, raw)
+	}
+	*value = parsed
+	return nil
+}
+
+// parseTokens reads a comma separated list of token:user_id pairs.
+func parseTokens(raw string) (map[string]uint, error) {
+	tokens := map[string]uint{}
+	for _, pair := range strings.Split(raw, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q isn't token:user_id", pair)
+		}
+		userID, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil || userID == 0 {
+			return nil, fmt.Errorf("%q isn't token:user_id", pair)
+		}
+		tokens[parts[0]] = uint(userID)
+	}
+	return tokens, nil
+}
@@ -1,76 +1,595 @@
 package service
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	_ "github.com/lib/pq" // needed
+	"gopkg.in/redis.v4"
 )
 
 var DB *sql.DB
 
+// errNoValue is what redisGetValue returns for a key with nothing stored
+// under it, whatever the backend.
+var errNoValue = errors.New("No value stored")
+
 type Database interface {
-	getFriendRequestByUserFromAndTo(userFrom, userTo uint) (FriendRequest, error)
-	insertFriendRequest(request FriendRequest) error
-	updateFriendRequest(request FriendRequest) error
-	redisGetValue(key string) (string, error)
-	redisSetValue(key, value string, seconds time.Duration) error
-	getFriendRequestByID(requestID uint) (FriendRequest, error)
-	getFriendsByUserID(userID uint) ([]FriendRequest, error)
+	getFriendRequestByUserFromAndTo(ctx context.Context, userFrom, userTo uint) (FriendRequest, error)
+	insertFriendRequest(ctx context.Context, request FriendRequest) error
+	updateFriendRequest(ctx context.Context, request FriendRequest) error
+	redisGetValue(ctx context.Context, key string) (string, error)
+	redisSetValue(ctx context.Context, key, value string, seconds time.Duration) error
+	getFriendRequestByID(ctx context.Context, requestID uint) (FriendRequest, error)
+	getFriendsByUserID(ctx context.Context, userID uint, page Page) ([]FriendRequest, error)
+	getFriendsByUserIDs(ctx context.Context, userIDs []uint, limit int) ([]FriendRequest, error)
+	getRequestsBetween(ctx context.Context, userID uint, otherIDs []uint) ([]FriendRequest, error)
+	getPendingRequestsToUser(ctx context.Context, userID uint, page Page) ([]FriendRequest, error)
+	getPendingRequestsFromUser(ctx context.Context, userID uint, rejectedSince time.Time, page Page) ([]FriendRequest, error)
+	expireFriendRequests(ctx context.Context, createdBefore time.Time) (int64, error)
+	insertBlock(ctx context.Context, block Block) error
+	deleteBlock(ctx context.Context, userID, blockedUserID uint) error
+	getBlockBetween(ctx context.Context, userA, userB uint) (Block, error)
+	getBlocksInvolvingUser(ctx context.Context, userID uint) ([]Block, error)
+	insertDismissedSuggestion(ctx context.Context, userID, dismissedUserID uint) error
+	getDismissedSuggestions(ctx context.Context, userID uint) ([]uint, error)
+	getSettings(ctx context.Context, userID uint) (Settings, error)
+	upsertSettings(ctx context.Context, settings Settings) error
+	insertFriendList(ctx context.Context, list FriendList) (uint, error)
+	updateFriendList(ctx context.Context, list FriendList) error
+	deleteFriendList(ctx context.Context, listID uint) error
+	getFriendList(ctx context.Context, listID uint) (FriendList, error)
+	getFriendListsByUserID(ctx context.Context, userID uint) ([]FriendList, error)
+	insertFriendListMember(ctx context.Context, listID, memberID uint) error
+	deleteFriendListMember(ctx context.Context, listID, memberID uint) error
+	removeFromFriendLists(ctx context.Context, userID, memberID uint) error
+	upsertFriendNote(ctx context.Context, note FriendNote) error
+	deleteFriendNote(ctx context.Context, userID, friendID uint) error
+	getFriendNotes(ctx context.Context, userID uint, friendIDs []uint) ([]FriendNote, error)
+	insertFavorite(ctx context.Context, userID, friendID uint) error
+	deleteFavorite(ctx context.Context, userID, friendID uint) error
+	getFavorites(ctx context.Context, userID uint) ([]uint, error)
+	getFollowRequest(ctx context.Context, follower, followee uint) (FriendRequest, error)
+	getFollowers(ctx context.Context, userID uint, page Page) ([]FriendRequest, error)
+	getFollowing(ctx context.Context, userID uint, page Page) ([]FriendRequest, error)
+	getPendingFollowRequests(ctx context.Context, userID uint, page Page) ([]FriendRequest, error)
+}
+
+// dataHandler stores everything in a SQL database. Its queries are written
+// for Postgres and rewritten for the dialect of other databases.
+type dataHandler struct {
+	// db is the database to use, the shared DB when nil.
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+func (d *dataHandler) conn() *sql.DB {
+	if d.db != nil {
+		return d.db
+	}
+	return DB
+}
+
+func (d *dataHandler) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return d.conn().QueryRowContext(ctx, d.dialect.rebind(query), args...)
+}
+
+func (d *dataHandler) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return d.conn().QueryContext(ctx, d.dialect.rebind(query), args...)
+}
+
+func (d *dataHandler) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return d.conn().ExecContext(ctx, d.dialect.rebind(query), args...)
+}
+
+var returningID = regexp.MustCompile(`\s+returning id;?\s*$`)
+
+// queryID runs an INSERT, UPDATE or DELETE ending in "returning id" and
+// returns the id, or sql.ErrNoRows when it touched no rows. Dialects without
+// RETURNING only know the id of an insert.
+func (d *dataHandler) queryID(ctx context.Context, query string, args ...interface{}) (uint, error) {
+	var id uint
+	if !d.dialect.lastInsertID {
+		err := d.queryRow(ctx, query, args...).Scan(&id)
+		return id, err
+	}
+	result, err := d.exec(ctx, returningID.ReplaceAllString(query, ";"), args...)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	if err == nil && affected == 0 {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		return 0, err
+	}
+	lastID, err := result.LastInsertId()
+	return uint(lastID), err
 }
 
-type dataHandler struct{}
+const friendRequestColumns = `ID, USER_FROM_ID, USER_TO_ID, STATUS, CREATED_AT,
+	ACCEPTED_AT, REJECTED_AT, CANCELLED_AT, ENDED_AT, ENDED_BY, KIND`
+
+// isFriendKind and isFollowKind limit a query to one kind of request.
+const (
+	isFriendKind = `kind='` + KindFriend + `'`
+	isFollowKind = `kind='` + KindFollow + `'`
+)
+
+func (d *dataHandler) getFriendRequestByUserFromAndTo(ctx context.Context, userFrom, userTo uint) (FriendRequest, error) {
+	row := d.queryRow(ctx, `SELECT `+friendRequestColumns+` FROM friend_requests
+		WHERE user_from_id=$1 AND user_to_id=$2 AND `+isFriendKind+`
+		ORDER BY created_at DESC, id DESC LIMIT 1;`, userFrom, userTo)
+	return scanFriendRequest(row)
+}
 
-func (d *dataHandler) getFriendRequestByUserFromAndTo(userFrom, userTo uint) (FriendRequest, error) {
-	var request FriendRequest
-	err := DB.QueryRow(`SELECT ID, USER_FROM_ID, USER_TO_ID, CREATED_AT, ACCEPTED_AT,
-		REJECTED_ID FROM friend_requests WHERE (user_from_id=$1 OR user_to_id=$1)
-		AND (user_from_id=$2 or user_to_id=$2);`, userFrom, userTo).Scan(request.ID,
-		request.UserFromID, request.UserToID, request.CreatedAt, request.AcceptedAt,
-		request.RejectedAt)
-	return request, err
+func (d *dataHandler) getFollowRequest(ctx context.Context, follower, followee uint) (FriendRequest, error) {
+	row := d.queryRow(ctx, `SELECT `+friendRequestColumns+` FROM friend_requests
+		WHERE user_from_id=$1 AND user_to_id=$2 AND `+isFollowKind+`
+		ORDER BY created_at DESC, id DESC LIMIT 1;`, follower, followee)
+	return scanFriendRequest(row)
 }
 
-func (d *dataHandler) getFriendRequestByID(requestID uint) (FriendRequest, error) {
-	var request FriendRequest
-	err := DB.QueryRow(`SELECT ID, USER_FROM_ID, USER_TO_ID, CREATED_AT, ACCEPTED_AT,
-		REJECTED_ID FROM friend_requests WHERE id=$1;`, requestID).Scan(request.ID,
-		request.UserFromID, request.UserToID, request.CreatedAt, request.AcceptedAt,
-		request.RejectedAt)
-	return request, err
+func (d *dataHandler) getFriendRequestByID(ctx context.Context, requestID uint) (FriendRequest, error) {
+	row := d.queryRow(ctx, `SELECT `+friendRequestColumns+` FROM friend_requests
+		WHERE id=$1;`, requestID)
+	return scanFriendRequest(row)
 }
 
-func (d *dataHandler) insertFriendRequest(request FriendRequest) error {
-	var lastInsertID uint
-	err := DB.QueryRow(`INSERT INTO friend_requests (USER_FROM_ID, USER_TO_ID)
-			VALUES($1, $2) returning id;`, request.UserFromID, request.UserToID).Scan(lastInsertID)
+func (d *dataHandler) insertFriendRequest(ctx context.Context, request FriendRequest) error {
+	kind := KindFriend
+	if request.isFollow() {
+		kind = KindFollow
+	}
+	_, err := d.queryID(ctx, `INSERT INTO friend_requests (USER_FROM_ID, USER_TO_ID, STATUS,
+			CREATED_AT, ACCEPTED_AT, KIND) VALUES($1, $2, $3, $4, $5, $6) returning id;`,
+		request.UserFromID, request.UserToID, request.Status, request.CreatedAt.UTC(),
+		nullTime(request.AcceptedAt), kind)
 	return err
 }
 
-func (d *dataHandler) updateFriendRequest(request FriendRequest) error {
-	var lastInsertID uint
-	err := DB.QueryRow(`UPDATE friend_requests SET accpected_at=$1, rejected_at=$2
-		WHERE ID=$3 returning id;`, request.AcceptedAt, request.RejectedAt,
-		request.ID).Scan(lastInsertID)
+func (d *dataHandler) updateFriendRequest(ctx context.Context, request FriendRequest) error {
+	_, err := d.queryID(ctx, `UPDATE friend_requests SET status=$1, accepted_at=$2,
+		rejected_at=$3, cancelled_at=$4, ended_at=$5, ended_by=$6 WHERE ID=$7
+		returning id;`, request.Status, nullTime(request.AcceptedAt),
+		nullTime(request.RejectedAt), nullTime(request.CancelledAt),
+		nullTime(request.EndedAt), nullUserID(request.EndedBy),
+		request.ID)
 	return err
 }
 
-func (d *dataHandler) getFriendsByUserID(userID uint) ([]FriendRequest, error) {
-	rows, err := DB.Query(`SELECT * FROM friend_requests WHERE (user_from_id=$1
-        OR user_to_id=$1) AND accepted_at !=0`, userID)
+// friendIDColumn is the id of the user on the other side of a request from
+// the point of view of the user in placeholder $1.
+const friendIDColumn = `CASE WHEN user_from_id=$1 THEN user_to_id ELSE user_from_id END`
+
+// pageClause returns the keyset condition and ordering for page when the
+// listing is sorted by the since column. Its placeholders are numbered from
+// first.
+func pageClause(page Page, since string, first int) (string, []interface{}) {
+	key := since
+	if page.Sort == sortUserID {
+		key = friendIDColumn
+	}
+	direction, comparison := "ASC", ">"
+	if page.descending() {
+		direction, comparison = "DESC", "<"
+	}
+
+	var clause string
+	var args []interface{}
+	if page.HasAfter {
+		clause = fmt.Sprintf(` AND (%s, id) %s ($%d, $%d)`, key, comparison, first, first+1)
+		args = append(args, page.afterValue(), page.AfterID)
+	}
+	clause += fmt.Sprintf(` ORDER BY %s %s, id %s LIMIT %d`, key, direction, direction, page.Limit)
+	return clause, args
+}
+
+// inList returns a parenthesised list of placeholders for ids, numbered from
+// first, along with the matching arguments.
+func inList(ids []uint, first int) (string, []interface{}) {
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = fmt.Sprintf("$%d", first+i)
+		args[i] = id
+	}
+	return "(" + strings.Join(placeholders, ", ") + ")", args
+}
+
+// queryRequestPage returns a page of the requests matching query, whose own
+// placeholders are bound to args.
+func (d *dataHandler) queryRequestPage(ctx context.Context, query string, page Page, since string,
+	args ...interface{}) ([]FriendRequest, error) {
+	clause, pageArgs := pageClause(page, since, len(args)+1)
+	args = append(args, pageArgs...)
+	rows, err := d.query(ctx, `SELECT `+friendRequestColumns+` FROM friend_requests
+		WHERE `+query+clause, args...)
 	if err != nil {
 		return []FriendRequest{}, err
 	}
-	requests := conevertRowsToRequests(rows)
-	return requests, nil
+	return conevertRowsToRequests(rows)
+}
+
+func (d *dataHandler) getFriendsByUserID(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	return d.queryRequestPage(ctx, `(user_from_id=$1 OR user_to_id=$1) AND status=$2 AND `+
+		isFriendKind, page, "accepted_at", userID, StatusAccepted)
+}
+
+func (d *dataHandler) getFollowers(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	return d.queryRequestPage(ctx, `user_to_id=$1 AND status=$2 AND `+isFollowKind,
+		page, "accepted_at", userID, StatusAccepted)
 }
 
-func (d *dataHandler) redisGetValue(key string) (string, error) {
-	return REDIS.Get(key).Result()
+func (d *dataHandler) getFollowing(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	return d.queryRequestPage(ctx, `user_from_id=$1 AND status=$2 AND `+isFollowKind,
+		page, "accepted_at", userID, StatusAccepted)
 }
 
-func (d *dataHandler) redisSetValue(key, value string, seconds time.Duration) error {
-	return REDIS.Set(key, value, seconds).Err()
+// getPendingFollowRequests returns the follows of a private account waiting
+// for its approval.
+func (d *dataHandler) getPendingFollowRequests(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	return d.queryRequestPage(ctx, `user_to_id=$1 AND status=$2 AND `+isFollowKind,
+		page, "created_at", userID, StatusPending)
+}
+
+// getFriendsByUserIDs returns at most limit friendships of the given users,
+// or all of them when limit is 0, oldest first.
+func (d *dataHandler) getFriendsByUserIDs(ctx context.Context, userIDs []uint, limit int) ([]FriendRequest, error) {
+	list, args := inList(userIDs, 2)
+	args = append([]interface{}{StatusAccepted}, args...)
+	clause := ` ORDER BY accepted_at, id`
+	if limit > 0 {
+		clause += fmt.Sprintf(` LIMIT %d`, limit)
+	}
+	rows, err := d.query(ctx, `SELECT `+friendRequestColumns+` FROM friend_requests
+		WHERE status=$1 AND `+isFriendKind+` AND (user_from_id IN `+list+`
+		OR user_to_id IN `+list+`)`+clause, args...)
+	if err != nil {
+		return []FriendRequest{}, err
+	}
+	return conevertRowsToRequests(rows)
+}
+
+// getRequestsBetween returns the pending, accepted and rejected requests
+// between userID and any of otherIDs, in either direction.
+func (d *dataHandler) getRequestsBetween(ctx context.Context, userID uint, otherIDs []uint) ([]FriendRequest, error) {
+	list, args := inList(otherIDs, 5)
+	args = append([]interface{}{userID, StatusPending, StatusAccepted, StatusRejected}, args...)
+	rows, err := d.query(ctx, `SELECT `+friendRequestColumns+` FROM friend_requests
+		WHERE status IN ($2, $3, $4) AND `+isFriendKind+`
+		AND ((user_from_id=$1 AND user_to_id IN `+list+`)
+		OR (user_to_id=$1 AND user_from_id IN `+list+`))`, args...)
+	if err != nil {
+		return []FriendRequest{}, err
+	}
+	return conevertRowsToRequests(rows)
+}
+
+func (d *dataHandler) getPendingRequestsToUser(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	return d.queryRequestPage(ctx, `user_to_id=$1 AND status=$2 AND `+isFriendKind,
+		page, "created_at", userID, StatusPending)
+}
+
+// getPendingRequestsFromUser also returns the requests rejected after
+// rejectedSince, which the sender keeps seeing as pending for a while.
+func (d *dataHandler) getPendingRequestsFromUser(ctx context.Context, userID uint, rejectedSince time.Time,
+	page Page) ([]FriendRequest, error) {
+	return d.queryRequestPage(ctx, `user_from_id=$1 AND (status=$2 OR (status=$3 AND rejected_at > $4)) AND `+
+		isFriendKind, page, "created_at", userID, StatusPending, StatusRejected, rejectedSince.UTC())
+}
+
+func (d *dataHandler) expireFriendRequests(ctx context.Context, createdBefore time.Time) (int64, error) {
+	result, err := d.exec(ctx, `UPDATE friend_requests SET status=$1 WHERE status=$2
+		AND created_at < $3`, StatusExpired, StatusPending, createdBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (d *dataHandler) insertBlock(ctx context.Context, block Block) error {
+	_, err := d.queryID(ctx, `INSERT INTO blocks (USER_ID, BLOCKED_USER_ID, CREATED_AT)
+		VALUES($1, $2, $3) returning id;`, block.UserID, block.BlockedUserID,
+		block.CreatedAt.UTC())
+	return err
+}
+
+func (d *dataHandler) deleteBlock(ctx context.Context, userID, blockedUserID uint) error {
+	_, err := d.queryID(ctx, `DELETE FROM blocks WHERE user_id=$1 AND blocked_user_id=$2
+		returning id;`, userID, blockedUserID)
+	return err
+}
+
+func (d *dataHandler) getBlockBetween(ctx context.Context, userA, userB uint) (Block, error) {
+	var block Block
+	err := d.queryRow(ctx, `SELECT ID, USER_ID, BLOCKED_USER_ID, CREATED_AT FROM blocks
+		WHERE (user_id=$1 AND blocked_user_id=$2) OR (user_id=$2 AND blocked_user_id=$1)
+		LIMIT 1;`, userA, userB).Scan(&block.ID, &block.UserID, &block.BlockedUserID,
+		&block.CreatedAt)
+	return block, err
+}
+
+func (d *dataHandler) getBlocksInvolvingUser(ctx context.Context, userID uint) ([]Block, error) {
+	rows, err := d.query(ctx, `SELECT ID, USER_ID, BLOCKED_USER_ID, CREATED_AT FROM blocks
+		WHERE user_id=$1 OR blocked_user_id=$1 ORDER BY created_at`, userID)
+	if err != nil {
+		return []Block{}, err
+	}
+	defer rows.Close()
+	var blocks []Block
+	for rows.Next() {
+		var block Block
+		err = rows.Scan(&block.ID, &block.UserID, &block.BlockedUserID, &block.CreatedAt)
+		if err != nil {
+			return []Block{}, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, rows.Err()
+}
+
+func (d *dataHandler) insertDismissedSuggestion(ctx context.Context, userID, dismissedUserID uint) error {
+	_, err := d.exec(ctx, `INSERT INTO dismissed_suggestions (USER_ID, DISMISSED_USER_ID,
+		CREATED_AT) VALUES($1, $2, $3) ON CONFLICT DO NOTHING;`, userID, dismissedUserID,
+		time.Now().UTC())
+	return err
+}
+
+func (d *dataHandler) getDismissedSuggestions(ctx context.Context, userID uint) ([]uint, error) {
+	rows, err := d.query(ctx, `SELECT DISMISSED_USER_ID FROM dismissed_suggestions
+		WHERE user_id=$1`, userID)
+	if err != nil {
+		return []uint{}, err
+	}
+	defer rows.Close()
+	var dismissed []uint
+	for rows.Next() {
+		var dismissedUserID uint
+		if err = rows.Scan(&dismissedUserID); err != nil {
+			return []uint{}, err
+		}
+		dismissed = append(dismissed, dismissedUserID)
+	}
+	return dismissed, rows.Err()
+}
+
+func (d *dataHandler) getSettings(ctx context.Context, userID uint) (Settings, error) {
+	var settings Settings
+	err := d.queryRow(ctx, `SELECT USER_ID, ALLOW_REQUESTS_FROM, PRIVATE FROM user_settings
+		WHERE user_id=$1;`, userID).Scan(&settings.UserID, &settings.AllowRequestsFrom,
+		&settings.Private)
+	return settings, err
+}
+
+func (d *dataHandler) upsertSettings(ctx context.Context, settings Settings) error {
+	_, err := d.exec(ctx, `INSERT INTO user_settings (USER_ID, ALLOW_REQUESTS_FROM, PRIVATE)
+		VALUES($1, $2, $3) ON CONFLICT (user_id) DO UPDATE SET
+		allow_requests_from=EXCLUDED.allow_requests_from, private=EXCLUDED.private;`,
+		settings.UserID, settings.AllowRequestsFrom, settings.Private)
+	return err
+}
+
+func (d *dataHandler) insertFriendList(ctx context.Context, list FriendList) (uint, error) {
+	return d.queryID(ctx, `INSERT INTO friend_lists (USER_ID, NAME, CREATED_AT)
+		VALUES($1, $2, $3) returning id;`, list.UserID, list.Name,
+		list.CreatedAt.UTC())
+}
+
+func (d *dataHandler) updateFriendList(ctx context.Context, list FriendList) error {
+	_, err := d.queryID(ctx, `UPDATE friend_lists SET name=$1 WHERE id=$2 returning id;`,
+		list.Name, list.ID)
+	return err
+}
+
+func (d *dataHandler) deleteFriendList(ctx context.Context, listID uint) error {
+	_, err := d.queryID(ctx, `DELETE FROM friend_lists WHERE id=$1 returning id;`, listID)
+	return err
+}
+
+func (d *dataHandler) getFriendList(ctx context.Context, listID uint) (FriendList, error) {
+	lists, err := d.queryFriendLists(ctx, `l.id=$1`, listID)
+	if err != nil {
+		return FriendList{}, err
+	}
+	if len(lists) == 0 {
+		return FriendList{}, sql.ErrNoRows
+	}
+	return lists[0], nil
+}
+
+func (d *dataHandler) getFriendListsByUserID(ctx context.Context, userID uint) ([]FriendList, error) {
+	return d.queryFriendLists(ctx, `l.user_id=$1`, userID)
+}
+
+// queryFriendLists loads the lists matching where along with their members.
+func (d *dataHandler) queryFriendLists(ctx context.Context, where string, arg uint) ([]FriendList, error) {
+	rows, err := d.query(ctx, `SELECT l.ID, l.USER_ID, l.NAME, l.CREATED_AT, m.MEMBER_ID
+		FROM friend_lists l LEFT JOIN friend_list_members m ON m.list_id = l.id
+		WHERE `+where+` ORDER BY l.id, m.member_id`, arg)
+	if err != nil {
+		return []FriendList{}, err
+	}
+	defer rows.Close()
+	lists := []FriendList{}
+	for rows.Next() {
+		var list FriendList
+		var memberID sql.NullInt64
+		err = rows.Scan(&list.ID, &list.UserID, &list.Name, &list.CreatedAt, &memberID)
+		if err != nil {
+			return []FriendList{}, err
+		}
+		if len(lists) == 0 || lists[len(lists)-1].ID != list.ID {
+			list.Members = []uint{}
+			lists = append(lists, list)
+		}
+		if memberID.Valid {
+			last := &lists[len(lists)-1]
+			last.Members = append(last.Members, uint(memberID.Int64))
+		}
+	}
+	return lists, rows.Err()
+}
+
+func (d *dataHandler) insertFriendListMember(ctx context.Context, listID, memberID uint) error {
+	_, err := d.exec(ctx, `INSERT INTO friend_list_members (LIST_ID, MEMBER_ID)
+		VALUES($1, $2) ON CONFLICT DO NOTHING;`, listID, memberID)
+	return err
+}
+
+func (d *dataHandler) deleteFriendListMember(ctx context.Context, listID, memberID uint) error {
+	_, err := d.exec(ctx, `DELETE FROM friend_list_members WHERE list_id=$1 AND member_id=$2;`,
+		listID, memberID)
+	return err
+}
+
+func (d *dataHandler) removeFromFriendLists(ctx context.Context, userID, memberID uint) error {
+	_, err := d.exec(ctx, `DELETE FROM friend_list_members WHERE member_id=$2 AND list_id IN
+		(SELECT id FROM friend_lists WHERE user_id=$1);`, userID, memberID)
+	return err
+}
+
+func (d *dataHandler) upsertFriendNote(ctx context.Context, note FriendNote) error {
+	_, err := d.exec(ctx, `INSERT INTO friend_notes (USER_ID, FRIEND_ID, NICKNAME, NOTE,
+		UPDATED_AT) VALUES($1, $2, $3, $4, $5) ON CONFLICT (user_id, friend_id) DO UPDATE
+		SET nickname=EXCLUDED.nickname, note=EXCLUDED.note, updated_at=EXCLUDED.updated_at;`,
+		note.UserID, note.FriendID, note.Nickname, note.Note, note.UpdatedAt.UTC())
+	return err
+}
+
+func (d *dataHandler) deleteFriendNote(ctx context.Context, userID, friendID uint) error {
+	_, err := d.exec(ctx, `DELETE FROM friend_notes WHERE user_id=$1 AND friend_id=$2;`,
+		userID, friendID)
+	return err
+}
+
+func (d *dataHandler) getFriendNotes(ctx context.Context, userID uint, friendIDs []uint) ([]FriendNote, error) {
+	list, args := inList(friendIDs, 2)
+	args = append([]interface{}{userID}, args...)
+	rows, err := d.query(ctx, `SELECT USER_ID, FRIEND_ID, NICKNAME, NOTE, UPDATED_AT
+		FROM friend_notes WHERE user_id=$1 AND friend_id IN `+list, args...)
+	if err != nil {
+		return []FriendNote{}, err
+	}
+	defer rows.Close()
+	var notes []FriendNote
+	for rows.Next() {
+		var note FriendNote
+		err = rows.Scan(&note.UserID, &note.FriendID, &note.Nickname, &note.Note,
+			&note.UpdatedAt)
+		if err != nil {
+			return []FriendNote{}, err
+		}
+		notes = append(notes, note)
+	}
+	return notes, rows.Err()
+}
+
+func (d *dataHandler) insertFavorite(ctx context.Context, userID, friendID uint) error {
+	_, err := d.exec(ctx, `INSERT INTO favorites (USER_ID, FRIEND_ID, CREATED_AT)
+		VALUES($1, $2, $3) ON CONFLICT DO NOTHING;`, userID, friendID, time.Now().UTC())
+	return err
+}
+
+func (d *dataHandler) deleteFavorite(ctx context.Context, userID, friendID uint) error {
+	_, err := d.exec(ctx, `DELETE FROM favorites WHERE user_id=$1 AND friend_id=$2;`,
+		userID, friendID)
+	return err
+}
+
+// getFavorites returns the friends userID marked as favorites, in the order
+// they were marked.
+func (d *dataHandler) getFavorites(ctx context.Context, userID uint) ([]uint, error) {
+	rows, err := d.query(ctx, `SELECT FRIEND_ID FROM favorites WHERE user_id=$1
+		ORDER BY created_at, friend_id`, userID)
+	if err != nil {
+		return []uint{}, err
+	}
+	defer rows.Close()
+	var favorites []uint
+	for rows.Next() {
+		var friendID uint
+		if err = rows.Scan(&friendID); err != nil {
+			return []uint{}, err
+		}
+		favorites = append(favorites, friendID)
+	}
+	return favorites, rows.Err()
+}
+
+func (d *dataHandler) redisGetValue(ctx context.Context, key string) (string, error) {
+	value, err := withRedis(ctx, func() (string, error) {
+		return REDIS.Get(key).Result()
+	})
+	if err == redis.Nil {
+		return "", errNoValue
+	}
+	return value, err
+}
+
+func (d *dataHandler) redisSetValue(ctx context.Context, key, value string, seconds time.Duration) error {
+	_, err := withRedis(ctx, func() (string, error) {
+		return "", REDIS.Set(key, value, seconds).Err()
+	})
+	return err
+}
+
+type redisResult struct {
+	value string
+	err   error
+}
+
+// withRedis runs call, giving up when ctx is done first. The redis client
+// can't be cancelled, so the call carries on in the background.
+func withRedis(ctx context.Context, call func() (string, error)) (string, error) {
+	done := make(chan redisResult, 1)
+	go func() {
+		value, err := call()
+		done <- redisResult{value, err}
+	}()
+	select {
+	case result := <-done:
+		return result.value, result.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// sqlDialect describes how a SQL database differs from Postgres. The zero
+// value is Postgres.
+type sqlDialect struct {
+	// questionPlaceholders spells placeholders ?1 rather than $1.
+	questionPlaceholders bool
+	// lastInsertID leaves out RETURNING clauses and reads the id of an insert
+	// from its result instead.
+	lastInsertID bool
+	migrations   []Migration
+}
+
+var postgresDialect = sqlDialect{migrations: postgresMigrations}
+
+var placeholder = regexp.MustCompile(`\$([0-9]+)`)
+
+// rebind rewrites a query written for Postgres for the dialect.
+func (s sqlDialect) rebind(query string) string {
+	if !s.questionPlaceholders {
+		return query
+	}
+	return placeholder.ReplaceAllString(query, "?$1")
+}
+
+// dialectFor returns the dialect of the given SQL backend.
+func dialectFor(backend string) sqlDialect {
+	if backend == BackendSQLite {
+		return sqliteDialect
+	}
+	return postgresDialect
 }
 
 //InitDatabase setup db connection
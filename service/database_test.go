@@ -0,0 +1,556 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+)
+
+// testDatabaseConformance checks that a Database behaves the way dataHandler
+// does. Every subtest gets a fresh, empty database from newDatabase, along
+// with a func to close it once the subtest is done.
+func testDatabaseConformance(t *testing.T, newDatabase func(t *testing.T) (Database, func())) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, database Database)
+	}{
+		{"RequestsByPair", conformRequestsByPair},
+		{"RequestUpdates", conformRequestUpdates},
+		{"FriendsAreAccepted", conformFriendsAreAccepted},
+		{"RequestsBetween", conformRequestsBetween},
+		{"PendingRequests", conformPendingRequests},
+		{"PendingRequestsByKind", conformPendingRequestsByKind},
+		{"ExpireRequests", conformExpireRequests},
+		{"ListingsOutOfTime", conformListingsOutOfTime},
+		{"Follows", conformFollows},
+		{"Blocks", conformBlocks},
+		{"DismissedSuggestions", conformDismissedSuggestions},
+		{"Settings", conformSettings},
+		{"FriendLists", conformFriendLists},
+		{"FriendNotes", conformFriendNotes},
+		{"Favorites", conformFavorites},
+		{"Values", conformValues},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			database, closeDatabase := newDatabase(t)
+			defer closeDatabase()
+			test.test(t, database)
+		})
+	}
+}
+
+func TestMemoryDatabaseConformance(t *testing.T) {
+	testDatabaseConformance(t, func(t *testing.T) (Database, func()) {
+		return newMemoryDatabase(), func() {}
+	})
+}
+
+func TestSQLiteDatabaseConformance(t *testing.T) {
+	testDatabaseConformance(t, func(t *testing.T) (Database, func()) {
+		return newSQLiteDatabase(t)
+	})
+}
+
+// TestPostgresDatabaseConformance runs the suite against Postgres when
+// TEST_DBURL points at a database it may wipe, in the same form as DBURL.
+func TestPostgresDatabaseConformance(t *testing.T) {
+	dburl := os.Getenv("TEST_DBURL")
+	if dburl == "" {
+		t.Skip("TEST_DBURL isn't set")
+	}
+	testDatabaseConformance(t, func(t *testing.T) (Database, func()) {
+		return newPostgresDatabase(t, dburl)
+	})
+}
+
+// newPostgresDatabase returns a dataHandler on the Postgres database at
+// dburl, emptied by reverting and reapplying every migration, along with a
+// func that reverts them again and closes it.
+func newPostgresDatabase(t *testing.T, dburl string) (*dataHandler, func()) {
+	db, err := InitDatabase(dburl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := len(postgresMigrations)
+	if _, err = MigrateDown(db, BackendPostgres, steps); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	if _, err = MigrateUp(db, BackendPostgres); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	return &dataHandler{db: db}, func() {
+		MigrateDown(db, BackendPostgres, steps)
+		db.Close()
+	}
+}
+
+// insertAccepted stores an accepted friendship between from and to.
+func insertAccepted(t *testing.T, database Database, from, to uint) FriendRequest {
+	if err := database.insertFriendRequest(ctx, AddFriend(from, to)); err != nil {
+		t.Fatal(err)
+	}
+	request, err := database.getFriendRequestByUserFromAndTo(ctx, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.accept()
+	if err = database.updateFriendRequest(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+// otherSides returns who userID is connected to by each request.
+func otherSides(userID uint, requests []FriendRequest) map[uint]bool {
+	ids := map[uint]bool{}
+	for _, request := range requests {
+		ids[request.friendID(userID)] = true
+	}
+	return ids
+}
+
+func conformRequestsByPair(t *testing.T, database Database) {
+	if _, err := database.getFriendRequestByUserFromAndTo(ctx, 1, 2); err != sql.ErrNoRows {
+		t.Fatalf("Expected sql.ErrNoRows before any request, got %v", err)
+	}
+	database.insertFriendRequest(ctx, AddFriend(1, 2))
+	first, err := database.getFriendRequestByUserFromAndTo(ctx, 1, 2)
+	if err != nil || first.ID == 0 || first.UserFromID != 1 || first.UserToID != 2 ||
+		!first.isPending() || first.Kind != KindFriend {
+		t.Fatalf("Expected the pending request from 1 to 2, got %+v (%v)", first, err)
+	}
+	if _, err = database.getFriendRequestByUserFromAndTo(ctx, 2, 1); err != sql.ErrNoRows {
+		t.Errorf("Expected no request from 2 to 1, got %v", err)
+	}
+
+	database.insertFriendRequest(ctx, AddFriend(1, 2))
+	second, _ := database.getFriendRequestByUserFromAndTo(ctx, 1, 2)
+	if second.ID == first.ID {
+		t.Errorf("Expected a duplicate request to get its own id, got %d twice", first.ID)
+	}
+	database.insertFriendRequest(ctx, AddFriend(2, 1))
+	reverse, err := database.getFriendRequestByUserFromAndTo(ctx, 2, 1)
+	if err != nil || reverse.UserFromID != 2 || reverse.ID == second.ID {
+		t.Errorf("Expected the request from 2 to 1, got %+v (%v)", reverse, err)
+	}
+	if latest, _ := database.getFriendRequestByUserFromAndTo(ctx, 1, 2); latest.ID != second.ID {
+		t.Errorf("Expected the newest request from 1 to 2, got %d", latest.ID)
+	}
+
+	stored, err := database.getFriendRequestByID(ctx, first.ID)
+	if err != nil || stored.ID != first.ID || stored.UserFromID != 1 || stored.UserToID != 2 {
+		t.Errorf("Expected request %d by id, got %+v (%v)", first.ID, stored, err)
+	}
+	if _, err = database.getFriendRequestByID(ctx, first.ID+100); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a missing id, got %v", err)
+	}
+}
+
+func conformRequestUpdates(t *testing.T, database Database) {
+	database.insertFriendRequest(ctx, AddFriend(1, 2))
+	database.insertFriendRequest(ctx, AddFriend(3, 2))
+	accepted, _ := database.getFriendRequestByUserFromAndTo(ctx, 1, 2)
+	rejected, _ := database.getFriendRequestByUserFromAndTo(ctx, 3, 2)
+
+	accepted.accept()
+	rejected.reject()
+	if err := database.updateFriendRequest(ctx, accepted); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.updateFriendRequest(ctx, rejected); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := database.getFriendRequestByID(ctx, accepted.ID)
+	if stored.Status != StatusAccepted || stored.AcceptedAt.IsZero() {
+		t.Errorf("Expected an accepted request with its time, got %+v", stored)
+	}
+	stored, _ = database.getFriendRequestByID(ctx, rejected.ID)
+	if stored.Status != StatusRejected || stored.RejectedAt.IsZero() || !stored.AcceptedAt.IsZero() {
+		t.Errorf("Expected a rejected request with its time, got %+v", stored)
+	}
+
+	stored, _ = database.getFriendRequestByID(ctx, accepted.ID)
+	stored.unfriend(2)
+	database.updateFriendRequest(ctx, stored)
+	stored, _ = database.getFriendRequestByID(ctx, accepted.ID)
+	if stored.Status != StatusUnfriended || stored.EndedAt.IsZero() || stored.EndedBy != 2 {
+		t.Errorf("Expected an ended friendship, got %+v", stored)
+	}
+
+	missing := AddFriend(4, 5)
+	missing.ID = accepted.ID + 100
+	if err := database.updateFriendRequest(ctx, missing); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows updating a missing request, got %v", err)
+	}
+}
+
+func conformFriendsAreAccepted(t *testing.T, database Database) {
+	insertAccepted(t, database, 1, 2)
+	insertAccepted(t, database, 3, 1)
+	database.insertFriendRequest(ctx, AddFriend(1, 4))
+	database.insertFriendRequest(ctx, AddFriend(5, 1))
+	rejected := AddFriend(6, 1)
+	database.insertFriendRequest(ctx, rejected)
+	rejected, _ = database.getFriendRequestByUserFromAndTo(ctx, 6, 1)
+	rejected.reject()
+	database.updateFriendRequest(ctx, rejected)
+	database.insertFriendRequest(ctx, FollowUser(1, 7, false))
+
+	friends, err := database.getFriendsByUserID(ctx, 1, Page{Limit: maxPageLimit, Sort: sortUserID})
+	ids := otherSides(1, friends)
+	if err != nil || len(friends) != 2 || !ids[2] || !ids[3] {
+		t.Fatalf("Expected friends 2 and 3, got %+v (%v)", friends, err)
+	}
+	if friends[0].friendID(1) != 2 {
+		t.Errorf("Expected friends sorted by user id, got %+v", friends)
+	}
+	friends, _ = database.getFriendsByUserID(ctx, 2, defaultPage())
+	if len(friends) != 1 || friends[0].friendID(2) != 1 {
+		t.Errorf("Expected the friendship from the other side too, got %+v", friends)
+	}
+
+	page := Page{Limit: 1, Sort: sortUserID}
+	friends, _ = database.getFriendsByUserID(ctx, 1, page)
+	page.HasAfter, page.AfterKey, page.AfterID = true, int64(friends[0].friendID(1)), friends[0].ID
+	friends, _ = database.getFriendsByUserID(ctx, 1, page)
+	if len(friends) != 1 || friends[0].friendID(1) != 3 {
+		t.Errorf("Expected friend 3 on the second page, got %+v", friends)
+	}
+
+	byTime := Page{Limit: 1, Sort: sortSinceAsc}
+	friends, _ = database.getFriendsByUserID(ctx, 1, byTime)
+	byTime.HasAfter, byTime.AfterKey, byTime.AfterID = true, friends[0].AcceptedAt.UnixNano(), friends[0].ID
+	friends, _ = database.getFriendsByUserID(ctx, 1, byTime)
+	if len(friends) != 1 || friends[0].friendID(1) != 3 {
+		t.Errorf("Expected friend 3, accepted second, on the second page, got %+v", friends)
+	}
+
+	friends, _ = database.getFriendsByUserIDs(ctx, []uint{2, 3}, 0)
+	if len(friends) != 2 {
+		t.Errorf("Expected both friendships of users 2 and 3, got %+v", friends)
+	}
+	friends, _ = database.getFriendsByUserIDs(ctx, []uint{2, 3}, 1)
+	if len(friends) != 1 {
+		t.Errorf("Expected a single friendship with a limit of 1, got %+v", friends)
+	}
+
+	// Friendships come oldest first, whatever order they were requested in.
+	database.insertFriendRequest(ctx, AddFriend(8, 9))
+	database.insertFriendRequest(ctx, AddFriend(8, 10))
+	for to, acceptedAt := range map[uint]time.Time{9: time.Now(), 10: time.Now().Add(-time.Hour)} {
+		request, _ := database.getFriendRequestByUserFromAndTo(ctx, 8, to)
+		request.accept()
+		request.AcceptedAt = acceptedAt
+		database.updateFriendRequest(ctx, request)
+	}
+	friends, _ = database.getFriendsByUserIDs(ctx, []uint{8}, 1)
+	if len(friends) != 1 || friends[0].friendID(8) != 10 {
+		t.Errorf("Expected the friendship accepted first, got %+v", friends)
+	}
+}
+
+func conformRequestsBetween(t *testing.T, database Database) {
+	insertAccepted(t, database, 1, 2)
+	database.insertFriendRequest(ctx, AddFriend(3, 1))
+	rejected := AddFriend(1, 4)
+	database.insertFriendRequest(ctx, rejected)
+	rejected, _ = database.getFriendRequestByUserFromAndTo(ctx, 1, 4)
+	rejected.reject()
+	database.updateFriendRequest(ctx, rejected)
+	cancelled := AddFriend(1, 5)
+	database.insertFriendRequest(ctx, cancelled)
+	cancelled, _ = database.getFriendRequestByUserFromAndTo(ctx, 1, 5)
+	cancelled.cancel()
+	database.updateFriendRequest(ctx, cancelled)
+	database.insertFriendRequest(ctx, FollowUser(1, 6, true))
+	database.insertFriendRequest(ctx, AddFriend(2, 3))
+
+	requests, err := database.getRequestsBetween(ctx, 1, []uint{2, 3, 4, 5, 6})
+	ids := otherSides(1, requests)
+	if err != nil || len(requests) != 3 || !ids[2] || !ids[3] || !ids[4] {
+		t.Errorf("Expected the requests with 2, 3 and 4, got %+v (%v)", requests, err)
+	}
+}
+
+func conformPendingRequests(t *testing.T, database Database) {
+	database.insertFriendRequest(ctx, AddFriend(2, 1))
+	database.insertFriendRequest(ctx, AddFriend(3, 1))
+	database.insertFriendRequest(ctx, AddFriend(1, 4))
+	rejected := AddFriend(1, 5)
+	database.insertFriendRequest(ctx, rejected)
+	rejected, _ = database.getFriendRequestByUserFromAndTo(ctx, 1, 5)
+	rejected.reject()
+	database.updateFriendRequest(ctx, rejected)
+	database.insertFriendRequest(ctx, AddFriend(1, 7))
+	old, _ := database.getFriendRequestByUserFromAndTo(ctx, 1, 7)
+	old.reject()
+	old.RejectedAt = time.Now().Add(-2 * time.Hour)
+	database.updateFriendRequest(ctx, old)
+	insertAccepted(t, database, 6, 1)
+
+	incoming, err := database.getPendingRequestsToUser(ctx, 1, defaultPage())
+	if ids := otherSides(1, incoming); err != nil || len(incoming) != 2 || !ids[2] || !ids[3] {
+		t.Errorf("Expected the requests from 2 and 3, got %+v (%v)", incoming, err)
+	}
+	outgoing, err := database.getPendingRequestsFromUser(ctx, 1, time.Now().Add(-time.Hour), defaultPage())
+	if ids := otherSides(1, outgoing); err != nil || len(outgoing) != 2 || !ids[4] || !ids[5] {
+		t.Errorf("Expected the requests to 4 and the recently rejected 5, got %+v (%v)", outgoing, err)
+	}
+	limited, _ := database.getPendingRequestsToUser(ctx, 1, Page{Limit: 1, Sort: sortSinceAsc})
+	if len(limited) != 1 || limited[0].UserFromID != 2 {
+		t.Errorf("Expected the oldest request alone, got %+v", limited)
+	}
+}
+
+// conformPendingRequestsByKind checks that friend and follow requests waiting
+// on the same users are listed apart.
+func conformPendingRequestsByKind(t *testing.T, database Database) {
+	database.insertFriendRequest(ctx, AddFriend(2, 1))
+	database.insertFriendRequest(ctx, FollowUser(3, 1, true))
+	database.insertFriendRequest(ctx, AddFriend(1, 4))
+	database.insertFriendRequest(ctx, FollowUser(1, 5, true))
+
+	incoming, err := database.getPendingRequestsToUser(ctx, 1, defaultPage())
+	if err != nil || len(incoming) != 1 || incoming[0].UserFromID != 2 {
+		t.Errorf("Expected the friend request from 2 alone, got %+v (%v)", incoming, err)
+	}
+	outgoing, err := database.getPendingRequestsFromUser(ctx, 1, time.Now().Add(-time.Hour), defaultPage())
+	if err != nil || len(outgoing) != 1 || outgoing[0].UserToID != 4 {
+		t.Errorf("Expected the friend request to 4 alone, got %+v (%v)", outgoing, err)
+	}
+	follows, err := database.getPendingFollowRequests(ctx, 1, defaultPage())
+	if err != nil || len(follows) != 1 || follows[0].UserFromID != 3 || !follows[0].isFollow() {
+		t.Errorf("Expected the follow request from 3 alone, got %+v (%v)", follows, err)
+	}
+}
+
+// conformListingsOutOfTime checks that listings which run out of time fail
+// rather than returning whatever they read in time.
+func conformListingsOutOfTime(t *testing.T, database Database) {
+	if _, ok := database.(*memoryDatabase); ok {
+		t.Skip("memoryDatabase never waits, so it ignores its context")
+	}
+	for _, id := range []uint{2, 3, 4} {
+		insertAccepted(t, database, 1, id)
+	}
+	expired, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer cancel()
+
+	friends, err := database.getFriendsByUserID(expired, 1, defaultPage())
+	if err != context.DeadlineExceeded || len(friends) != 0 {
+		t.Errorf("Listing friends: expected %v, got %+v (%v)", context.DeadlineExceeded, friends, err)
+	}
+	friends, err = database.getFriendsByUserIDs(expired, []uint{1}, 0)
+	if err != context.DeadlineExceeded || len(friends) != 0 {
+		t.Errorf("Loading friendships: expected %v, got %+v (%v)", context.DeadlineExceeded, friends, err)
+	}
+	friends, err = database.getRequestsBetween(expired, 1, []uint{2, 3, 4})
+	if err != context.DeadlineExceeded || len(friends) != 0 {
+		t.Errorf("Requests between: expected %v, got %+v (%v)", context.DeadlineExceeded, friends, err)
+	}
+}
+
+func conformExpireRequests(t *testing.T, database Database) {
+	old := AddFriend(1, 2)
+	old.CreatedAt = time.Now().Add(-time.Hour)
+	database.insertFriendRequest(ctx, old)
+	database.insertFriendRequest(ctx, AddFriend(1, 3))
+	insertAccepted(t, database, 1, 4)
+
+	expired, err := database.expireFriendRequests(ctx, time.Now().Add(-time.Minute))
+	if err != nil || expired != 1 {
+		t.Fatalf("Expected one request to expire, got %d (%v)", expired, err)
+	}
+	stored, _ := database.getFriendRequestByUserFromAndTo(ctx, 1, 2)
+	if stored.Status != StatusExpired {
+		t.Errorf("Expected the old request to have expired, got %s", stored.Status)
+	}
+	if stored, _ = database.getFriendRequestByUserFromAndTo(ctx, 1, 3); !stored.isPending() {
+		t.Errorf("Expected the new request to stay pending, got %s", stored.Status)
+	}
+}
+
+func conformFollows(t *testing.T, database Database) {
+	if _, err := database.getFollowRequest(ctx, 1, 2); err != sql.ErrNoRows {
+		t.Fatalf("Expected sql.ErrNoRows before any follow, got %v", err)
+	}
+	database.insertFriendRequest(ctx, FollowUser(1, 2, false))
+	database.insertFriendRequest(ctx, FollowUser(3, 2, true))
+	follow, err := database.getFollowRequest(ctx, 1, 2)
+	if err != nil || !follow.isFollow() || follow.Status != StatusAccepted || follow.AcceptedAt.IsZero() {
+		t.Fatalf("Expected an accepted follow, got %+v (%v)", follow, err)
+	}
+	if _, err = database.getFriendRequestByUserFromAndTo(ctx, 1, 2); err != sql.ErrNoRows {
+		t.Errorf("Expected a follow not to be a friend request, got %v", err)
+	}
+
+	followers, _ := database.getFollowers(ctx, 2, defaultPage())
+	if len(followers) != 1 || followers[0].UserFromID != 1 {
+		t.Errorf("Expected user 1 alone to follow user 2, got %+v", followers)
+	}
+	following, _ := database.getFollowing(ctx, 1, defaultPage())
+	if len(following) != 1 || following[0].UserToID != 2 {
+		t.Errorf("Expected user 1 to follow user 2, got %+v", following)
+	}
+	if friends, _ := database.getFriendsByUserID(ctx, 1, defaultPage()); len(friends) != 0 {
+		t.Errorf("Expected a follow not to be a friendship, got %+v", friends)
+	}
+}
+
+func conformBlocks(t *testing.T, database Database) {
+	if _, err := database.getBlockBetween(ctx, 1, 2); err != sql.ErrNoRows {
+		t.Fatalf("Expected sql.ErrNoRows before any block, got %v", err)
+	}
+	if err := database.insertBlock(ctx, BlockUser(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.insertBlock(ctx, BlockUser(1, 2)); err == nil {
+		t.Errorf("Expected blocking the same user twice to fail")
+	}
+	database.insertBlock(ctx, BlockUser(3, 1))
+	database.insertBlock(ctx, BlockUser(4, 5))
+
+	for _, pair := range [][2]uint{{1, 2}, {2, 1}} {
+		block, err := database.getBlockBetween(ctx, pair[0], pair[1])
+		if err != nil || block.UserID != 1 || block.BlockedUserID != 2 {
+			t.Errorf("Expected the block between %v, got %+v (%v)", pair, block, err)
+		}
+	}
+	if blocks, _ := database.getBlocksInvolvingUser(ctx, 1); len(blocks) != 2 {
+		t.Errorf("Expected 2 blocks involving user 1, got %+v", blocks)
+	}
+	if err := database.deleteBlock(ctx, 2, 1); err != sql.ErrNoRows {
+		t.Errorf("Expected only the blocker to lift a block, got %v", err)
+	}
+	if err := database.deleteBlock(ctx, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.getBlockBetween(ctx, 1, 2); err != sql.ErrNoRows {
+		t.Errorf("Expected the block to be gone, got %v", err)
+	}
+}
+
+func conformDismissedSuggestions(t *testing.T, database Database) {
+	database.insertDismissedSuggestion(ctx, 1, 2)
+	database.insertDismissedSuggestion(ctx, 1, 2)
+	database.insertDismissedSuggestion(ctx, 1, 3)
+	database.insertDismissedSuggestion(ctx, 4, 5)
+	dismissed, err := database.getDismissedSuggestions(ctx, 1)
+	if err != nil || len(dismissed) != 2 || !containsID(dismissed, 2) || !containsID(dismissed, 3) {
+		t.Errorf("Expected 2 and 3 dismissed once each, got %v (%v)", dismissed, err)
+	}
+}
+
+func conformSettings(t *testing.T, database Database) {
+	if _, err := database.getSettings(ctx, 1); err != sql.ErrNoRows {
+		t.Fatalf("Expected sql.ErrNoRows before any settings, got %v", err)
+	}
+	database.upsertSettings(ctx, Settings{UserID: 1, AllowRequestsFrom: AllowNobody})
+	database.upsertSettings(ctx, Settings{UserID: 1, AllowRequestsFrom: AllowFriendsOfFriends, Private: true})
+	settings, err := database.getSettings(ctx, 1)
+	if err != nil || settings.AllowRequestsFrom != AllowFriendsOfFriends || !settings.Private {
+		t.Errorf("Expected the newest settings, got %+v (%v)", settings, err)
+	}
+}
+
+func conformFriendLists(t *testing.T, database Database) {
+	listID, err := database.insertFriendList(ctx, CreateFriendList(1, "Close"))
+	if err != nil || listID == 0 {
+		t.Fatalf("Expected the list to get an id, got %d (%v)", listID, err)
+	}
+	if _, err = database.insertFriendList(ctx, CreateFriendList(1, "Close")); err == nil {
+		t.Errorf("Expected a second list with the same name to fail")
+	}
+	otherID, _ := database.insertFriendList(ctx, CreateFriendList(2, "Close"))
+	if err = database.insertFriendListMember(ctx, listID+otherID+100, 2); err == nil {
+		t.Errorf("Expected adding to a missing list to fail")
+	}
+
+	database.insertFriendListMember(ctx, listID, 3)
+	database.insertFriendListMember(ctx, listID, 2)
+	database.insertFriendListMember(ctx, listID, 3)
+	database.insertFriendListMember(ctx, otherID, 3)
+	list, err := database.getFriendList(ctx, listID)
+	if err != nil || list.UserID != 1 || list.Name != "Close" || len(list.Members) != 2 ||
+		list.Members[0] != 2 || list.Members[1] != 3 {
+		t.Fatalf("Expected members 2 and 3, got %+v (%v)", list, err)
+	}
+
+	list.Name = "Closest"
+	if err = database.updateFriendList(ctx, list); err != nil {
+		t.Fatal(err)
+	}
+	database.deleteFriendListMember(ctx, listID, 2)
+	database.removeFromFriendLists(ctx, 1, 3)
+	lists, _ := database.getFriendListsByUserID(ctx, 1)
+	if len(lists) != 1 || lists[0].Name != "Closest" || len(lists[0].Members) != 0 {
+		t.Errorf("Expected the renamed, empty list, got %+v", lists)
+	}
+	if other, _ := database.getFriendList(ctx, otherID); len(other.Members) != 1 {
+		t.Errorf("Expected other users' lists to keep their members, got %+v", other)
+	}
+
+	if err = database.deleteFriendList(ctx, listID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = database.getFriendList(ctx, listID); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a deleted list, got %v", err)
+	}
+	if err = database.updateFriendList(ctx, list); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows renaming a deleted list, got %v", err)
+	}
+	if err = database.deleteFriendList(ctx, listID); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows deleting a deleted list, got %v", err)
+	}
+}
+
+func conformFriendNotes(t *testing.T, database Database) {
+	database.upsertFriendNote(ctx, FriendNote{UserID: 1, FriendID: 2, Nickname: "Bo", UpdatedAt: time.Now()})
+	database.upsertFriendNote(ctx, FriendNote{UserID: 1, FriendID: 2, Note: "Met at work", UpdatedAt: time.Now()})
+	database.upsertFriendNote(ctx, FriendNote{UserID: 1, FriendID: 3, Nickname: "Cy", UpdatedAt: time.Now()})
+	database.upsertFriendNote(ctx, FriendNote{UserID: 2, FriendID: 1, Nickname: "Al", UpdatedAt: time.Now()})
+
+	notes, err := database.getFriendNotes(ctx, 1, []uint{1, 2})
+	if err != nil || len(notes) != 1 || notes[0].FriendID != 2 || notes[0].Nickname != "" ||
+		notes[0].Note != "Met at work" {
+		t.Errorf("Expected the replaced note on friend 2, got %+v (%v)", notes, err)
+	}
+	database.deleteFriendNote(ctx, 1, 3)
+	if notes, _ = database.getFriendNotes(ctx, 1, []uint{3}); len(notes) != 0 {
+		t.Errorf("Expected the note on friend 3 to be gone, got %+v", notes)
+	}
+}
+
+func conformFavorites(t *testing.T, database Database) {
+	database.insertFavorite(ctx, 1, 2)
+	database.insertFavorite(ctx, 1, 3)
+	database.insertFavorite(ctx, 1, 2)
+	database.insertFavorite(ctx, 4, 2)
+	favorites, err := database.getFavorites(ctx, 1)
+	if err != nil || len(favorites) != 2 || favorites[0] != 2 || favorites[1] != 3 {
+		t.Errorf("Expected favorites 2 and 3 once each, got %v (%v)", favorites, err)
+	}
+	database.deleteFavorite(ctx, 1, 2)
+	if favorites, _ = database.getFavorites(ctx, 1); len(favorites) != 1 || favorites[0] != 3 {
+		t.Errorf("Expected favorite 3 alone, got %v", favorites)
+	}
+}
+
+func conformValues(t *testing.T, database Database) {
+	if _, ok := database.(*dataHandler); ok {
+		t.Skip("dataHandler keeps its values in Redis")
+	}
+	if _, err := database.redisGetValue(ctx, "TOKEN"); err != errNoValue {
+		t.Errorf("Expected a missing key to be %v, got %v", errNoValue, err)
+	}
+	database.redisSetValue(ctx, "TOKEN", "1", time.Minute)
+	if value, err := database.redisGetValue(ctx, "TOKEN"); err != nil || value != "1" {
+		t.Errorf("Expected the stored value, got %q (%v)", value, err)
+	}
+}
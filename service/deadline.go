@@ -0,0 +1,286 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// deadlineDatabase gives every operation on the database it wraps timeout to
+// finish, on top of whatever deadline the caller's context already has.
+type deadlineDatabase struct {
+	Database
+	timeout time.Duration
+}
+
+// withDeadlines limits each operation on database to timeout. Zero leaves
+// operations to the caller's context alone.
+func withDeadlines(database Database, timeout time.Duration) Database {
+	if timeout <= 0 {
+		return database
+	}
+	return &deadlineDatabase{Database: database, timeout: timeout}
+}
+
+func (d *deadlineDatabase) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, d.timeout)
+}
+
+// deadlineErr reports context.DeadlineExceeded for an operation that failed
+// because it ran out of time, whatever error the backend gave up with.
+func deadlineErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (d *deadlineDatabase) getFriendRequestByUserFromAndTo(ctx context.Context, userFrom, userTo uint) (FriendRequest, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getFriendRequestByUserFromAndTo(ctx, userFrom, userTo)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) insertFriendRequest(ctx context.Context, request FriendRequest) error {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	return deadlineErr(ctx, d.Database.insertFriendRequest(ctx, request))
+}
+
+func (d *deadlineDatabase) updateFriendRequest(ctx context.Context, request FriendRequest) error {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	return deadlineErr(ctx, d.Database.updateFriendRequest(ctx, request))
+}
+
+func (d *deadlineDatabase) redisGetValue(ctx context.Context, key string) (string, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.redisGetValue(ctx, key)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) redisSetValue(ctx context.Context, key, value string, seconds time.Duration) error {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	return deadlineErr(ctx, d.Database.redisSetValue(ctx, key, value, seconds))
+}
+
+func (d *deadlineDatabase) getFriendRequestByID(ctx context.Context, requestID uint) (FriendRequest, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getFriendRequestByID(ctx, requestID)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) getFriendsByUserID(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getFriendsByUserID(ctx, userID, page)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) getFriendsByUserIDs(ctx context.Context, userIDs []uint, limit int) ([]FriendRequest, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getFriendsByUserIDs(ctx, userIDs, limit)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) getRequestsBetween(ctx context.Context, userID uint, otherIDs []uint) ([]FriendRequest, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getRequestsBetween(ctx, userID, otherIDs)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) getPendingRequestsToUser(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getPendingRequestsToUser(ctx, userID, page)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) getPendingRequestsFromUser(ctx context.Context, userID uint, rejectedSince time.Time,
+	page Page) ([]FriendRequest, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getPendingRequestsFromUser(ctx, userID, rejectedSince, page)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) expireFriendRequests(ctx context.Context, createdBefore time.Time) (int64, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.expireFriendRequests(ctx, createdBefore)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) insertBlock(ctx context.Context, block Block) error {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	return deadlineErr(ctx, d.Database.insertBlock(ctx, block))
+}
+
+func (d *deadlineDatabase) deleteBlock(ctx context.Context, userID, blockedUserID uint) error {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	return deadlineErr(ctx, d.Database.deleteBlock(ctx, userID, blockedUserID))
+}
+
+func (d *deadlineDatabase) getBlockBetween(ctx context.Context, userA, userB uint) (Block, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getBlockBetween(ctx, userA, userB)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) getBlocksInvolvingUser(ctx context.Context, userID uint) ([]Block, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getBlocksInvolvingUser(ctx, userID)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) insertDismissedSuggestion(ctx context.Context, userID, dismissedUserID uint) error {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	return deadlineErr(ctx, d.Database.insertDismissedSuggestion(ctx, userID, dismissedUserID))
+}
+
+func (d *deadlineDatabase) getDismissedSuggestions(ctx context.Context, userID uint) ([]uint, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getDismissedSuggestions(ctx, userID)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) getSettings(ctx context.Context, userID uint) (Settings, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getSettings(ctx, userID)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) upsertSettings(ctx context.Context, settings Settings) error {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	return deadlineErr(ctx, d.Database.upsertSettings(ctx, settings))
+}
+
+func (d *deadlineDatabase) insertFriendList(ctx context.Context, list FriendList) (uint, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.insertFriendList(ctx, list)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) updateFriendList(ctx context.Context, list FriendList) error {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	return deadlineErr(ctx, d.Database.updateFriendList(ctx, list))
+}
+
+func (d *deadlineDatabase) deleteFriendList(ctx context.Context, listID uint) error {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	return deadlineErr(ctx, d.Database.deleteFriendList(ctx, listID))
+}
+
+func (d *deadlineDatabase) getFriendList(ctx context.Context, listID uint) (FriendList, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getFriendList(ctx, listID)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) getFriendListsByUserID(ctx context.Context, userID uint) ([]FriendList, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getFriendListsByUserID(ctx, userID)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) insertFriendListMember(ctx context.Context, listID, memberID uint) error {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	return deadlineErr(ctx, d.Database.insertFriendListMember(ctx, listID, memberID))
+}
+
+func (d *deadlineDatabase) deleteFriendListMember(ctx context.Context, listID, memberID uint) error {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	return deadlineErr(ctx, d.Database.deleteFriendListMember(ctx, listID, memberID))
+}
+
+func (d *deadlineDatabase) removeFromFriendLists(ctx context.Context, userID, memberID uint) error {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	return deadlineErr(ctx, d.Database.removeFromFriendLists(ctx, userID, memberID))
+}
+
+func (d *deadlineDatabase) upsertFriendNote(ctx context.Context, note FriendNote) error {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	return deadlineErr(ctx, d.Database.upsertFriendNote(ctx, note))
+}
+
+func (d *deadlineDatabase) deleteFriendNote(ctx context.Context, userID, friendID uint) error {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	return deadlineErr(ctx, d.Database.deleteFriendNote(ctx, userID, friendID))
+}
+
+func (d *deadlineDatabase) getFriendNotes(ctx context.Context, userID uint, friendIDs []uint) ([]FriendNote, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getFriendNotes(ctx, userID, friendIDs)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) insertFavorite(ctx context.Context, userID, friendID uint) error {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	return deadlineErr(ctx, d.Database.insertFavorite(ctx, userID, friendID))
+}
+
+func (d *deadlineDatabase) deleteFavorite(ctx context.Context, userID, friendID uint) error {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	return deadlineErr(ctx, d.Database.deleteFavorite(ctx, userID, friendID))
+}
+
+func (d *deadlineDatabase) getFavorites(ctx context.Context, userID uint) ([]uint, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getFavorites(ctx, userID)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) getFollowRequest(ctx context.Context, follower, followee uint) (FriendRequest, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getFollowRequest(ctx, follower, followee)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) getFollowers(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getFollowers(ctx, userID, page)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) getFollowing(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getFollowing(ctx, userID, page)
+	return result, deadlineErr(ctx, err)
+}
+
+func (d *deadlineDatabase) getPendingFollowRequests(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	ctx, cancel := d.withDeadline(ctx)
+	defer cancel()
+	result, err := d.Database.getPendingFollowRequests(ctx, userID, page)
+	return result, deadlineErr(ctx, err)
+}
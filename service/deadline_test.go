@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/urfave/negroni"
+)
+
+// slowDatabase is a memoryDatabase whose friend listings, request, list and
+// block lookups, sweeps and SLOW token lookups don't return until their
+// context is done.
+type slowDatabase struct {
+	*memoryDatabase
+}
+
+// stall waits out ctx like a query against a database that stopped answering.
+func stall(ctx context.Context) error {
+	<-ctx.Done()
+	return errors.New("connection closed")
+}
+
+func (s *slowDatabase) getFriendsByUserID(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	return nil, stall(ctx)
+}
+
+func (s *slowDatabase) getFriendRequestByID(ctx context.Context, requestID uint) (FriendRequest, error) {
+	return FriendRequest{}, stall(ctx)
+}
+
+func (s *slowDatabase) getFriendList(ctx context.Context, listID uint) (FriendList, error) {
+	return FriendList{}, stall(ctx)
+}
+
+func (s *slowDatabase) getBlockBetween(ctx context.Context, userA, userB uint) (Block, error) {
+	return Block{}, stall(ctx)
+}
+
+func (s *slowDatabase) deleteBlock(ctx context.Context, userID, blockedUserID uint) error {
+	return stall(ctx)
+}
+
+func (s *slowDatabase) expireFriendRequests(ctx context.Context, createdBefore time.Time) (int64, error) {
+	return 0, stall(ctx)
+}
+
+func (s *slowDatabase) redisGetValue(ctx context.Context, key string) (string, error) {
+	if key == "SLOW" {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	return s.memoryDatabase.redisGetValue(ctx, key)
+}
+
+func makeDeadlineTestServer(database Database) *negroni.Negroni {
+	server := negroni.New(AuthMiddleware(database, testConfig.ServiceTokens))
+	mx := mux.NewRouter()
+	initRoutes(mx, formatter, database, testConfig)
+	server.UseHandler(mx)
+	return server
+}
+
+func TestDeadlineDatabaseReportsDeadlineExceeded(t *testing.T) {
+	database := withDeadlines(&slowDatabase{newRequestTestDatabase()}, 10*time.Millisecond)
+
+	_, err := database.getFriendsByUserID(ctx, 1, defaultPage())
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if _, err = database.getFriendRequestByUserFromAndTo(ctx, 1, 2); err != nil {
+		t.Errorf("Expected every operation to get its own deadline, got %v", err)
+	}
+	if withDeadlines(database, 0) != database {
+		t.Errorf("Expected a zero timeout to leave the database alone")
+	}
+}
+
+func TestHandlersTimeOutWithGatewayTimeout(t *testing.T) {
+	database := withDeadlines(&slowDatabase{newRequestTestDatabase()}, 10*time.Millisecond)
+	server := makeDeadlineTestServer(database)
+
+	for _, route := range []struct{ method, url, token string }{
+		{"GET", "/friends", "SENDER"},
+		{"PUT", "/friends/1/accept", "RECIPIENT"},
+		{"DELETE", "/friends/requests/1", "SENDER"},
+		{"GET", "/friends/lists/1", "SENDER"},
+		{"DELETE", "/blocks/2", "SENDER"},
+	} {
+		recorder = serveTestRequest(server, route.method, route.url, route.token)
+		if recorder.Code != http.StatusGatewayTimeout {
+			t.Errorf("%s %s: expected %d, got %d", route.method, route.url, http.StatusGatewayTimeout, recorder.Code)
+		}
+	}
+	recorder = serveTestJSON(server, "POST", "/blocks", "SENDER", "{\"blocked_user_id\": 2}")
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected %d blocking, got %d", http.StatusGatewayTimeout, recorder.Code)
+	}
+	recorder = serveTestRequest(server, "GET", "/friends/requests/incoming", "RECIPIENT")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected other operations to succeed, got %d", recorder.Code)
+	}
+}
+
+func TestAuthMiddlewareTimesOutWithGatewayTimeout(t *testing.T) {
+	database := withDeadlines(&slowDatabase{newRequestTestDatabase()}, 10*time.Millisecond)
+	server := makeDeadlineTestServer(database)
+
+	recorder = serveTestRequest(server, "GET", "/friends/requests/incoming", "SLOW")
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected %d looking up the token, got %d", http.StatusGatewayTimeout, recorder.Code)
+	}
+
+	// Handlers look the token up again, and time out the same way.
+	recorder = serveTestRequest(MakeTestServer(database), "GET", "/friends/requests/incoming", "SLOW")
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected %d from the handler, got %d", http.StatusGatewayTimeout, recorder.Code)
+	}
+}
+
+func TestSQLiteStopsWhenCancelled(t *testing.T) {
+	database, closeDatabase := newSQLiteDatabase(t)
+	defer closeDatabase()
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err := database.getFriendsByUserID(cancelled, 1, defaultPage()); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if err := database.insertFriendRequest(cancelled, AddFriend(1, 2)); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestRequestRowsFailWhenCancelledPartway(t *testing.T) {
+	database, closeDatabase := newSQLiteDatabase(t)
+	defer closeDatabase()
+	for id := uint(2); id <= 4; id++ {
+		database.insertFriendRequest(ctx, AddFriend(1, id))
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	rows, err := database.query(cancelled, `SELECT `+friendRequestColumns+` FROM friend_requests`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	// database/sql closes the rows in the background once the context is done.
+	time.Sleep(50 * time.Millisecond)
+
+	if requests, err := conevertRowsToRequests(rows); err != context.Canceled || len(requests) != 0 {
+		t.Errorf("Expected context.Canceled and no requests, got %+v (%v)", requests, err)
+	}
+}
+
+func TestRequestSweeperGivesUpAfterTimeout(t *testing.T) {
+	sweeper := startRequestSweeper(&slowDatabase{newRequestTestDatabase()}, time.Hour, time.Hour,
+		10*time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		sweeper.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the sweep to give up once it ran out of time")
+	}
+}
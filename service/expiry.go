@@ -0,0 +1,178 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// expiringDatabase expires pending requests that have outlived the TTL as
+// they are read, so they stop counting even before the sweeper gets to them.
+type expiringDatabase struct {
+	Database
+	ttl time.Duration
+}
+
+// withRequestExpiry wraps database so stale pending requests are expired on
+// read. A zero ttl leaves database as it is.
+func withRequestExpiry(database Database, ttl time.Duration) Database {
+	if ttl <= 0 {
+		return database
+	}
+	return &expiringDatabase{Database: database, ttl: ttl}
+}
+
+func (e *expiringDatabase) refresh(ctx context.Context, request FriendRequest) FriendRequest {
+	if request.isStale(e.ttl, time.Now()) && request.expire() == nil {
+		// Best effort, the sweeper catches anything that fails to save here.
+		if err := e.Database.updateFriendRequest(ctx, request); err != nil {
+			log.Printf("Failed to expire friend request %d: %v", request.ID, err)
+		}
+	}
+	return request
+}
+
+func (e *expiringDatabase) getFriendRequestByUserFromAndTo(ctx context.Context, userFrom, userTo uint) (FriendRequest, error) {
+	request, err := e.Database.getFriendRequestByUserFromAndTo(ctx, userFrom, userTo)
+	if err != nil {
+		return request, err
+	}
+	return e.refresh(ctx, request), nil
+}
+
+func (e *expiringDatabase) getFollowRequest(ctx context.Context, follower, followee uint) (FriendRequest, error) {
+	request, err := e.Database.getFollowRequest(ctx, follower, followee)
+	if err != nil {
+		return request, err
+	}
+	return e.refresh(ctx, request), nil
+}
+
+func (e *expiringDatabase) getFriendRequestByID(ctx context.Context, requestID uint) (FriendRequest, error) {
+	request, err := e.Database.getFriendRequestByID(ctx, requestID)
+	if err != nil {
+		return request, err
+	}
+	return e.refresh(ctx, request), nil
+}
+
+func (e *expiringDatabase) getRequestsBetween(ctx context.Context, userID uint, otherIDs []uint) ([]FriendRequest, error) {
+	requests, err := e.Database.getRequestsBetween(ctx, userID, otherIDs)
+	if err != nil {
+		return requests, err
+	}
+	for i := range requests {
+		requests[i] = e.refresh(ctx, requests[i])
+	}
+	return requests, nil
+}
+
+func (e *expiringDatabase) getPendingRequestsToUser(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	return e.pendingPage(ctx, userID, page, e.Database.getPendingRequestsToUser)
+}
+
+func (e *expiringDatabase) getPendingRequestsFromUser(ctx context.Context, userID uint, rejectedSince time.Time,
+	page Page) ([]FriendRequest, error) {
+	list := func(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+		return e.Database.getPendingRequestsFromUser(ctx, userID, rejectedSince, page)
+	}
+	return e.pendingPage(ctx, userID, page, list)
+}
+
+func (e *expiringDatabase) getPendingFollowRequests(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	return e.pendingPage(ctx, userID, page, e.Database.getPendingFollowRequests)
+}
+
+// pendingPage drops stale requests from a page of pending requests, reading
+// on past them so the page still fills up when there is more to show.
+func (e *expiringDatabase) pendingPage(ctx context.Context, userID uint, page Page,
+	list func(ctx context.Context, userID uint, page Page) ([]FriendRequest, error)) ([]FriendRequest, error) {
+	want := page.Limit
+	var fresh []FriendRequest
+	for {
+		page.Limit = want - len(fresh)
+		requests, err := list(ctx, userID, page)
+		if err != nil {
+			return []FriendRequest{}, err
+		}
+		for _, request := range requests {
+			if request = e.refresh(ctx, request); request.Status != StatusExpired {
+				fresh = append(fresh, request)
+			}
+		}
+		if len(requests) < page.Limit || len(fresh) == want {
+			return fresh, nil
+		}
+		last := requests[len(requests)-1]
+		page.AfterKey = page.key(userID, last, requestedSince)
+		page.AfterID = last.ID
+		page.HasAfter = true
+	}
+}
+
+// requestSweeper periodically expires every pending request older than ttl,
+// giving each sweep up to timeout. Zero lets sweeps run as long as they take.
+type requestSweeper struct {
+	database Database
+	ttl      time.Duration
+	interval time.Duration
+	timeout  time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+func startRequestSweeper(database Database, ttl, interval, timeout time.Duration) *requestSweeper {
+	sweeper := &requestSweeper{
+		database: database,
+		ttl:      ttl,
+		interval: interval,
+		timeout:  timeout,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go sweeper.run()
+	return sweeper
+}
+
+func (s *requestSweeper) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	s.sweep()
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *requestSweeper) sweep() {
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	expired, err := s.database.expireFriendRequests(ctx, time.Now().Add(-s.ttl))
+	if err != nil {
+		log.Printf("Failed to expire friend requests: %v", err)
+		return
+	}
+	if expired > 0 {
+		log.Printf("Expired %d friend requests", expired)
+	}
+}
+
+// Stop ends the sweeper and waits for a sweep in progress to finish.
+func (s *requestSweeper) Stop() {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+}
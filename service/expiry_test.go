@@ -0,0 +1,98 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+// testRequestTTL lets the requests from users 3 to 5 stay pending.
+const testRequestTTL = 5*24*time.Hour + 12*time.Hour
+
+// newExpiryTestDatabase holds pending requests to user 2 from users 3 to 7,
+// where the request from user n was sent n days ago.
+func newExpiryTestDatabase() *memoryDatabase {
+	database := newMemoryDatabase()
+	now := time.Now()
+	for id := uint(3); id <= 7; id++ {
+		database.insertFriendRequest(ctx, FriendRequest{
+			UserFromID: id,
+			UserToID:   2,
+			Status:     StatusPending,
+			CreatedAt:  now.Add(-time.Duration(id) * 24 * time.Hour),
+		})
+	}
+	return database
+}
+
+func TestExpiringDatabaseExpiresOnRead(t *testing.T) {
+	database := newExpiryTestDatabase()
+	expiring := withRequestExpiry(database, testRequestTTL)
+
+	request, err := expiring.getFriendRequestByID(ctx, database.requests[3].ID)
+	if err != nil || request.Status != StatusExpired {
+		t.Errorf("Expected the request from 6 to expire, got %+v (%v)", request, err)
+	}
+	if database.requests[3].Status != StatusExpired {
+		t.Error("Expected the expiry to be saved")
+	}
+
+	request, _ = expiring.getFriendRequestByUserFromAndTo(ctx, 3, 2)
+	if request.Status != StatusPending {
+		t.Errorf("Expected the request from 3 to still be pending, got %s", request.Status)
+	}
+}
+
+func TestExpiringDatabaseListingSkipsStale(t *testing.T) {
+	database := newExpiryTestDatabase()
+	expiring := withRequestExpiry(database, testRequestTTL)
+
+	page := defaultPage()
+	page.Sort = sortSinceAsc
+	page.Limit = 2
+	requests, _ := expiring.getPendingRequestsToUser(ctx, 2, page)
+
+	if len(requests) != 2 || requests[0].UserFromID != 5 || requests[1].UserFromID != 4 {
+		t.Errorf("Expected the requests from 5 and 4, got %+v", requests)
+	}
+	for _, request := range database.requests[3:] {
+		if request.Status != StatusExpired {
+			t.Errorf("Expected the request from %d to expire while listing", request.UserFromID)
+		}
+	}
+}
+
+func TestExpiredRequestDoesNotBlockNewRequest(t *testing.T) {
+	database := newExpiryTestDatabase()
+	expiring := withRequestExpiry(database, testRequestTTL)
+
+	if exists, _ := hasFriendRequest(ctx, 7, 2, expiring); exists {
+		t.Error("An expired request should not block a new one")
+	}
+	if exists, _ := hasFriendRequest(ctx, 3, 2, expiring); !exists {
+		t.Error("A fresh pending request should block a new one")
+	}
+}
+
+func TestWithRequestExpiryDisabled(t *testing.T) {
+	database := newExpiryTestDatabase()
+	if withRequestExpiry(database, 0) != Database(database) {
+		t.Error("A zero TTL should not wrap the database")
+	}
+}
+
+func TestRequestSweeper(t *testing.T) {
+	database := newExpiryTestDatabase()
+	sweeper := startRequestSweeper(database, testRequestTTL, time.Hour, 0)
+	sweeper.Stop()
+	sweeper.Stop()
+
+	for _, request := range database.requests {
+		expected := StatusPending
+		if request.UserFromID > 5 {
+			expected = StatusExpired
+		}
+		if request.Status != expected {
+			t.Errorf("Request from %d: expected %s, got %s", request.UserFromID, expected, request.Status)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+var (
+	errNoPath          = errors.New("No friendship path found")
+	errPathSearchLimit = errors.New("Path search visited too many users")
+)
+
+//FriendPath is a chain of friends from one user to another
+type FriendPath struct {
+	Path    []uint `json:"path"`
+	Degrees int    `json:"degrees"`
+}
+
+// friendGraph maps each user to their friends, keeping the accepted request
+// behind every friendship.
+type friendGraph map[uint]map[uint]FriendRequest
+
+// loadFriendGraph loads every friendship of the given users in one query.
+// Only the given users are guaranteed to have all their friends in the graph.
+func loadFriendGraph(ctx context.Context, userIDs []uint, database Database) (friendGraph, error) {
+	graph := friendGraph{}
+	if len(userIDs) == 0 {
+		return graph, nil
+	}
+	requests, err := database.getFriendsByUserIDs(ctx, userIDs, 0)
+	if err != nil {
+		return graph, err
+	}
+	return graphFromRequests(requests), nil
+}
+
+func graphFromRequests(requests []FriendRequest) friendGraph {
+	graph := friendGraph{}
+	for _, request := range requests {
+		graph.add(request)
+	}
+	return graph
+}
+
+func (g friendGraph) add(request FriendRequest) {
+	for _, userID := range []uint{request.UserFromID, request.UserToID} {
+		if g[userID] == nil {
+			g[userID] = map[uint]FriendRequest{}
+		}
+		g[userID][request.friendID(userID)] = request
+	}
+}
+
+// friendIDs returns userID's friends in ascending order.
+func (g friendGraph) friendIDs(userID uint) []uint {
+	ids := make([]uint, 0, len(g[userID]))
+	for friendID := range g[userID] {
+		ids = append(ids, friendID)
+	}
+	sort.Sort(userIDs(ids))
+	return ids
+}
+
+// mutual returns the friends userA and userB share in ascending order.
+func (g friendGraph) mutual(userA, userB uint) []uint {
+	var shared []uint
+	for _, friendID := range g.friendIDs(userA) {
+		if _, ok := g[userB][friendID]; ok {
+			shared = append(shared, friendID)
+		}
+	}
+	return shared
+}
+
+// friend returns userID's friendship with friendID as a Friend.
+func (g friendGraph) friend(userID, friendID uint) Friend {
+	request := g[userID][friendID]
+	return friendsFromRequests(userID, []FriendRequest{request})[0]
+}
+
+// shortestFriendPath finds the shortest chain of friends from one user to the
+// other that is at most maxDepth friendships long. It searches from both ends
+// at once, always widening the smaller frontier, and gives up before loading
+// a layer that could take it past maxVisited users. Users with a block
+// between them and from never appear in the path, so it can't reveal a block
+// or lead through someone who blocked the searcher.
+func shortestFriendPath(ctx context.Context, from, to uint, maxDepth, maxVisited int, database Database) ([]uint, error) {
+	if from == to {
+		return []uint{from}, nil
+	}
+	blocks, err := database.getBlocksInvolvingUser(ctx, from)
+	if err != nil {
+		return []uint{}, err
+	}
+	excluded := map[uint]bool{}
+	for _, block := range blocks {
+		excluded[block.UserID] = true
+		excluded[block.BlockedUserID] = true
+	}
+	delete(excluded, from)
+	if excluded[to] {
+		return []uint{}, errNoPath
+	}
+
+	// Each side maps the users it reached to the user it reached them from.
+	forward := map[uint]uint{from: 0}
+	backward := map[uint]uint{to: 0}
+	forwardFrontier, backwardFrontier := []uint{from}, []uint{to}
+
+	for depth := 0; depth < maxDepth; depth++ {
+		if len(forwardFrontier) == 0 || len(backwardFrontier) == 0 {
+			break
+		}
+		frontier, seen, other := &forwardFrontier, forward, backward
+		if len(backwardFrontier) < len(forwardFrontier) {
+			frontier, seen, other = &backwardFrontier, backward, forward
+		}
+
+		// Each friendship loaded reaches at most one new user, so loading one
+		// more than the budget has left tells whether the layer fits in it.
+		remaining := maxVisited - len(forward) - len(backward)
+		if remaining <= 0 {
+			return []uint{}, errPathSearchLimit
+		}
+		requests, err := database.getFriendsByUserIDs(ctx, *frontier, remaining+1)
+		if err != nil {
+			return []uint{}, err
+		}
+		if len(requests) > remaining {
+			return []uint{}, errPathSearchLimit
+		}
+		graph := graphFromRequests(requests)
+		var next []uint
+		for _, userID := range *frontier {
+			for _, friendID := range graph.friendIDs(userID) {
+				if _, ok := seen[friendID]; ok || excluded[friendID] {
+					continue
+				}
+				seen[friendID] = userID
+				if _, ok := other[friendID]; ok {
+					return joinPath(friendID, forward, backward), nil
+				}
+				next = append(next, friendID)
+			}
+		}
+		*frontier = next
+	}
+	return []uint{}, errNoPath
+}
+
+// joinPath walks back from the user where both searches met to either end.
+func joinPath(meeting uint, forward, backward map[uint]uint) []uint {
+	var path []uint
+	for userID := meeting; userID != 0; userID = forward[userID] {
+		path = append([]uint{userID}, path...)
+	}
+	for userID := backward[meeting]; userID != 0; userID = backward[userID] {
+		path = append(path, userID)
+	}
+	return path
+}
+
+type userIDs []uint
+
+func (u userIDs) Len() int           { return len(u) }
+func (u userIDs) Less(i, j int) bool { return u[i] < u[j] }
+func (u userIDs) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func checkFriendPath(t *testing.T, database *memoryDatabase, path []uint, from, to uint, degrees int) {
+	if len(path) != degrees+1 || path[0] != from || path[len(path)-1] != to {
+		t.Errorf("Expected a %d degree path from %d to %d, got %v", degrees, from, to, path)
+		return
+	}
+	graph, _ := loadFriendGraph(ctx, path, database)
+	for i := 1; i < len(path); i++ {
+		if _, ok := graph[path[i-1]][path[i]]; !ok {
+			t.Errorf("%d and %d in %v aren't friends", path[i-1], path[i], path)
+		}
+	}
+}
+
+func TestShortestFriendPath(t *testing.T) {
+	database := newGraphTestDatabase()
+
+	for _, tc := range []struct {
+		from, to uint
+		degrees  int
+	}{
+		{1, 1, 0},
+		{1, 2, 1},
+		{1, 5, 2},
+		{1, 7, 3},
+		{7, 1, 3},
+		{6, 7, 5},
+	} {
+		path, err := shortestFriendPath(ctx, tc.from, tc.to, 5, 100, database)
+		if err != nil {
+			t.Errorf("%d to %d: %v", tc.from, tc.to, err)
+			continue
+		}
+		checkFriendPath(t, database, path, tc.from, tc.to, tc.degrees)
+	}
+}
+
+func TestShortestFriendPathLimits(t *testing.T) {
+	database := newGraphTestDatabase()
+
+	if _, err := shortestFriendPath(ctx, 1, 8, 4, 100, database); err != errNoPath {
+		t.Errorf("Unconnected users: expected %v, got %v", errNoPath, err)
+	}
+	if _, err := shortestFriendPath(ctx, 6, 7, 4, 100, database); err != errNoPath {
+		t.Errorf("Too deep: expected %v, got %v", errNoPath, err)
+	}
+	if _, err := shortestFriendPath(ctx, 6, 7, 5, 3, database); err != errPathSearchLimit {
+		t.Errorf("Too many visited: expected %v, got %v", errPathSearchLimit, err)
+	}
+}
+
+// rowCountingDatabase records how many friendships each graph load returned.
+type rowCountingDatabase struct {
+	Database
+	rows []int
+}
+
+func (r *rowCountingDatabase) getFriendsByUserIDs(ctx context.Context, userIDs []uint, limit int) ([]FriendRequest, error) {
+	requests, err := r.Database.getFriendsByUserIDs(ctx, userIDs, limit)
+	r.rows = append(r.rows, len(requests))
+	return requests, err
+}
+
+func TestShortestFriendPathCapsLoadedRows(t *testing.T) {
+	database := &rowCountingDatabase{Database: newGraphTestDatabase()}
+
+	if _, err := shortestFriendPath(ctx, 1, 7, 5, 4, database); err != errPathSearchLimit {
+		t.Errorf("Expected %v, got %v", errPathSearchLimit, err)
+	}
+	for _, rows := range database.rows {
+		if rows > 3 {
+			t.Errorf("Expected no load past the budget left, got %v", database.rows)
+		}
+	}
+}
+
+func TestShortestFriendPathSkipsBlockedUsers(t *testing.T) {
+	database := newGraphTestDatabase()
+	database.insertBlock(ctx, Block{UserID: 1, BlockedUserID: 2})
+
+	path, err := shortestFriendPath(ctx, 1, 7, 5, 100, database)
+	if err != nil || len(path) != 4 || path[1] != 3 {
+		t.Errorf("Expected the path around the blocked user, got %v (%v)", path, err)
+	}
+
+	// A block the other way hides the user just the same.
+	database.insertBlock(ctx, Block{UserID: 5, BlockedUserID: 1})
+	if _, err := shortestFriendPath(ctx, 1, 7, 5, 100, database); err != errNoPath {
+		t.Errorf("Expected no path through a user who blocked the searcher, got %v", err)
+	}
+	if _, err := shortestFriendPath(ctx, 1, 5, 5, 100, database); err != errNoPath {
+		t.Errorf("Expected no path to a user who blocked the searcher, got %v", err)
+	}
+}
+
+func TestFriendPathHandler(t *testing.T) {
+	var path FriendPath
+
+	database := newGraphTestDatabase()
+	server := MakeTestServer(database)
+
+	recorder := serveTestRequest(server, "GET", "/friends/path/7", "U1")
+	json.Unmarshal(recorder.Body.Bytes(), &path)
+	if recorder.Code != http.StatusOK || path.Degrees != 3 {
+		t.Errorf("Expected a 3 degree path, got %v %+v", recorder.Code, path)
+	}
+	checkFriendPath(t, database, path.Path, 1, 7, 3)
+
+	for url, expected := range map[string]int{
+		"/friends/path/8":              http.StatusNotFound,
+		"/friends/path/7?max_depth=2":  http.StatusNotFound,
+		"/friends/path/7?max_depth=0":  http.StatusBadRequest,
+		"/friends/path/7?max_depth=99": http.StatusBadRequest,
+	} {
+		recorder = serveTestRequest(server, "GET", url, "U1")
+		if recorder.Code != expected {
+			t.Errorf("%s: expected %v; received %v", url, expected, recorder.Code)
+		}
+	}
+}
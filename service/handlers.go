@@ -1,20 +1,25 @@
 package service
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/gorilla/mux"
 	"github.com/unrolled/render"
 )
 
-func postAddFriendHandler(formatter *render.Render, database Database) http.HandlerFunc {
+func postAddFriendHandler(formatter *render.Render, database Database, config Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
 		userID, err := getUserFromHeader(req, database)
-		if err != nil || userID == uint(0) {
-			formatter.JSON(w, http.StatusForbidden, "No auth header sent")
+		if err != nil {
+			authError(w, formatter, err)
 			return
 		}
 
@@ -26,17 +31,89 @@ func postAddFriendHandler(formatter *render.Render, database Database) http.Hand
 			formatter.Text(w, http.StatusBadRequest, "Failed to parse request.")
 			return
 		}
+		if request.UserToID == userID {
+			formatter.Text(w, http.StatusBadRequest, "You can't send yourself a request.")
+			return
+		}
+
+		block, err := database.getBlockBetween(ctx, userID, request.UserToID)
+		if err != nil && err != sql.ErrNoRows {
+			storageError(w, formatter, err, "Failed to add request.")
+			return
+		}
+		if err == nil && block.UserID == userID {
+			formatter.Text(w, http.StatusForbidden, "You have blocked this user.")
+			return
+		}
+		if err == nil {
+			// Don't let the blocked user find out they were blocked.
+			formatter.Text(w, http.StatusCreated, "Request succesfully created.")
+			return
+		}
+
+		// A pending request the other way means both users want this, so
+		// accept it rather than leaving two requests crossed.
+		crossed, err := database.getFriendRequestByUserFromAndTo(ctx, request.UserToID, userID)
+		if err == nil && crossed.isPending() {
+			if err = crossed.accept(); err != nil {
+				formatter.JSON(w, http.StatusConflict, err.Error())
+				return
+			}
+			if err = database.updateFriendRequest(ctx, crossed); err != nil {
+				storageError(w, formatter, err, "Failed to update request.")
+				return
+			}
+			formatter.JSON(w, http.StatusOK, friendsFromRequests(userID, []FriendRequest{crossed})[0])
+			return
+		}
+
+		last, err := database.getFriendRequestByUserFromAndTo(ctx, userID, request.UserToID)
+		if err != nil && err != sql.ErrNoRows {
+			storageError(w, formatter, err, "Failed to add request.")
+			return
+		}
+		var wait time.Duration
+		if err == nil {
+			wait = last.cooldownLeft(config.RejectionCooldown, time.Now())
+		}
 
-		if hasFriendRequest(userID, request.UserToID, database) == true {
+		between, err := getRequestBetween(ctx, userID, request.UserToID, database)
+		if err != nil && err != sql.ErrNoRows {
+			storageError(w, formatter, err, "Failed to add request.")
+			return
+		}
+		if err == nil && between.Status == StatusAccepted {
 			formatter.Text(w, http.StatusBadRequest, "Request already exists.")
 			return
 		}
+		// The sender still sees a rejected request as pending during the
+		// cooldown, so asking again while it is pending gets the same answer,
+		// waiting out a whole cooldown.
+		pending := err == nil && between.isPending()
+		if pending {
+			wait = config.RejectionCooldown
+		}
+		if pending || wait > 0 {
+			setRetryAfter(w, wait)
+			formatter.Text(w, http.StatusTooManyRequests, "Please wait before sending another request.")
+			return
+		}
+
+		allowed, err := acceptsRequestFrom(ctx, userID, request.UserToID, database)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to add request.")
+			return
+		}
+		if !allowed {
+			formatter.Text(w, http.StatusForbidden, "This user isn't accepting friend requests.")
+			return
+		}
 
 		request = AddFriend(userID, request.UserToID)
-		err = database.insertFriendRequest(request)
+		err = database.insertFriendRequest(ctx, request)
 
 		if err != nil {
-			formatter.Text(w, http.StatusBadRequest, "Failed to add request.")
+			storageError(w, formatter, err, "Failed to add request.")
 			return
 		}
 		formatter.Text(w, http.StatusCreated, "Request succesfully created.")
@@ -45,24 +122,33 @@ func postAddFriendHandler(formatter *render.Render, database Database) http.Hand
 
 func rejectRequestHandler(formatter *render.Render, database Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		vars := mux.Vars(req)
-		key := vars["request_id"]
-		if key == "" {
-			formatter.JSON(w, http.StatusNotFound, "No request id sent.")
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
 			return
 		}
-		requestID, _ := strconv.ParseUint(key, 10, 32)
-		request, err := database.getFriendRequestByID(uint(requestID))
-
-		if err != nil {
+		request, err := getFriendRequestFromVars(req, database)
+		if err == sql.ErrNoRows {
 			formatter.JSON(w, http.StatusNotFound, "No request found.")
 			return
 		}
-		request.reject()
-		err = database.updateFriendRequest(request)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get request.")
+			return
+		}
+		if request.UserToID != userID {
+			formatter.JSON(w, http.StatusForbidden, "Only the recipient can reject this request.")
+			return
+		}
+		if err = request.reject(); err != nil {
+			formatter.JSON(w, http.StatusConflict, err.Error())
+			return
+		}
+		err = database.updateFriendRequest(ctx, request)
 
 		if err != nil {
-			formatter.JSON(w, http.StatusInternalServerError, "Failed to update request.")
+			storageError(w, formatter, err, "Failed to update request.")
 			return
 		}
 		formatter.JSON(w, http.StatusOK, "Request rejected")
@@ -71,41 +157,1082 @@ func rejectRequestHandler(formatter *render.Render, database Database) http.Hand
 
 func acceptRequestHandler(formatter *render.Render, database Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		vars := mux.Vars(req)
-		key := vars["request_id"]
-		if key == "" {
-			formatter.JSON(w, http.StatusNotFound, "No request id sent.")
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		request, err := getFriendRequestFromVars(req, database)
+		if err == sql.ErrNoRows {
+			formatter.JSON(w, http.StatusNotFound, "No request found.")
+			return
+		}
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get request.")
+			return
+		}
+		if request.UserToID != userID {
+			formatter.JSON(w, http.StatusForbidden, "Only the recipient can accept this request.")
+			return
+		}
+		if err = request.accept(); err != nil {
+			formatter.JSON(w, http.StatusConflict, err.Error())
+			return
+		}
+		err = database.updateFriendRequest(ctx, request)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to update request.")
 			return
 		}
-		requestID, _ := strconv.ParseUint(key, 10, 32)
-		request, err := database.getFriendRequestByID(uint(requestID))
+		formatter.JSON(w, http.StatusOK, "Request accepted")
+	}
+}
+
+func cancelRequestHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
 		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		request, err := getFriendRequestFromVars(req, database)
+		if err == sql.ErrNoRows {
 			formatter.JSON(w, http.StatusNotFound, "No request found.")
 			return
 		}
-		request.accept()
-		err = database.updateFriendRequest(request)
 		if err != nil {
-			formatter.JSON(w, http.StatusNotFound, "Failed to update request.")
+			storageError(w, formatter, err, "Failed to get request.")
 			return
 		}
-		formatter.JSON(w, http.StatusOK, "Request rejected")
+		if request.UserFromID != userID {
+			formatter.JSON(w, http.StatusForbidden, "Only the sender can cancel this request.")
+			return
+		}
+		if err = request.cancel(); err != nil {
+			formatter.JSON(w, http.StatusConflict, err.Error())
+			return
+		}
+		err = database.updateFriendRequest(ctx, request)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to update request.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, "Request cancelled")
+	}
+}
+
+func unfriendHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		friendID, err := getUserIDFromVars(req)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "No user id sent.")
+			return
+		}
+		err = endFriendship(ctx, userID, friendID, database)
+		if err == errNoFriendship {
+			formatter.JSON(w, http.StatusNotFound, "No friendship found.")
+			return
+		}
+		if err != nil {
+			storageError(w, formatter, err, "Failed to update request.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, "Friendship ended")
+	}
+}
+
+func putFavoriteHandler(formatter *render.Render, database Database, config Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		friendID, err := getUserIDFromVars(req)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "No user id sent.")
+			return
+		}
+		request, err := getRequestBetween(ctx, userID, friendID, database)
+		if err != nil && err != sql.ErrNoRows {
+			storageError(w, formatter, err, "Failed to save favorite.")
+			return
+		}
+		if err != nil || request.Status != StatusAccepted {
+			formatter.JSON(w, http.StatusNotFound, "No friendship found.")
+			return
+		}
+
+		favorites, err := database.getFavorites(ctx, userID)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get favorites.")
+			return
+		}
+		if containsID(favorites, friendID) {
+			formatter.JSON(w, http.StatusOK, "Friend favorited")
+			return
+		}
+		if len(favorites) >= config.MaxFavorites {
+			formatter.JSON(w, http.StatusConflict, "Too many favorites.")
+			return
+		}
+		err = database.insertFavorite(ctx, userID, friendID)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to save favorite.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, "Friend favorited")
+	}
+}
+
+func deleteFavoriteHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		friendID, err := getUserIDFromVars(req)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "No user id sent.")
+			return
+		}
+		favorites, err := database.getFavorites(ctx, userID)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get favorites.")
+			return
+		}
+		if !containsID(favorites, friendID) {
+			formatter.JSON(w, http.StatusNotFound, "Friend isn't a favorite.")
+			return
+		}
+		err = database.deleteFavorite(ctx, userID, friendID)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to delete favorite.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, "Favorite removed")
+	}
+}
+
+func putFriendNoteHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		friendID, err := getUserIDFromVars(req)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "No user id sent.")
+			return
+		}
+
+		var note FriendNote
+		payload, _ := ioutil.ReadAll(req.Body)
+		err = json.Unmarshal(payload, &note)
+		if err != nil || !note.valid() {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse note.")
+			return
+		}
+		request, err := getRequestBetween(ctx, userID, friendID, database)
+		if err != nil && err != sql.ErrNoRows {
+			storageError(w, formatter, err, "Failed to save note.")
+			return
+		}
+		if err != nil || request.Status != StatusAccepted {
+			formatter.JSON(w, http.StatusNotFound, "No friendship found.")
+			return
+		}
+
+		note.UserID, note.FriendID, note.UpdatedAt = userID, friendID, time.Now()
+		note.Nickname = strings.TrimSpace(note.Nickname)
+		if note.empty() {
+			err = database.deleteFriendNote(ctx, userID, friendID)
+		} else {
+			err = database.upsertFriendNote(ctx, note)
+		}
+		if err != nil {
+			storageError(w, formatter, err, "Failed to save note.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, note)
+	}
+}
+
+func deleteFriendNoteHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		friendID, err := getUserIDFromVars(req)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "No user id sent.")
+			return
+		}
+		err = database.deleteFriendNote(ctx, userID, friendID)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to delete note.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, "Note deleted")
 	}
 }
 
 func getFriendsHandler(formatter *render.Render, database Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		page, err := parsePage(req)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, "Invalid page parameters.")
+			return
+		}
+		onlyFavorites := false
+		if raw := req.URL.Query().Get("favorites"); raw != "" {
+			onlyFavorites, err = strconv.ParseBool(raw)
+			if err != nil {
+				formatter.JSON(w, http.StatusBadRequest, "Invalid favorites parameter.")
+				return
+			}
+		}
+		var requests []FriendRequest
+		nextCursor := ""
+		if !onlyFavorites {
+			requests, err = database.getFriendsByUserID(ctx, userID, page)
+			if err != nil {
+				storageError(w, formatter, err, "Failed to get friends.")
+				return
+			}
+			nextCursor = page.nextCursor(userID, requests, friendsSince)
+		}
+		// Older clients still expect the raw request rows, so the cursor
+		// travels in a header for them.
+		if req.URL.Query().Get("format") == "requests" && !onlyFavorites {
+			w.Header().Set("X-Next-Cursor", nextCursor)
+			formatter.JSON(w, http.StatusOK, requests)
+			return
+		}
+
+		// Favorites lead the first page and are left out of the pages
+		// that follow, so they are only ever listed once.
+		favorites, err := database.getFavorites(ctx, userID)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get friends.")
+			return
+		}
+		friends := []Friend{}
+		if !page.HasAfter || onlyFavorites {
+			friends, err = favoriteFriends(ctx, userID, favorites, database)
+			if err != nil {
+				storageError(w, formatter, err, "Failed to get friends.")
+				return
+			}
+		}
+		for _, friend := range friendsFromRequests(userID, requests) {
+			if !containsID(favorites, friend.UserID) {
+				friends = append(friends, friend)
+			}
+		}
+
+		if err = countMutualFriends(ctx, userID, friends, database); err != nil {
+			storageError(w, formatter, err, "Failed to get friends.")
+			return
+		}
+		if err = attachFriendNotes(ctx, userID, friends, database); err != nil {
+			storageError(w, formatter, err, "Failed to get friends.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, FriendsPage{
+			Friends:    friends,
+			NextCursor: nextCursor,
+		})
+	}
+}
+
+func getMutualFriendsHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		otherID, err := getUserIDFromVars(req)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "No user id sent.")
+			return
+		}
+		if otherID == userID {
+			formatter.JSON(w, http.StatusBadRequest, "Can't compare friends with yourself.")
+			return
+		}
+		graph, err := loadFriendGraph(ctx, []uint{userID, otherID}, database)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get friends.")
+			return
+		}
+		mutual := []Friend{}
+		for _, friendID := range graph.mutual(userID, otherID) {
+			mutual = append(mutual, graph.friend(userID, friendID))
+		}
+		if err = attachFriendNotes(ctx, userID, mutual, database); err != nil {
+			storageError(w, formatter, err, "Failed to get friends.")
+			return
+		}
+		favorites, err := database.getFavorites(ctx, userID)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get friends.")
+			return
+		}
+		for i := range mutual {
+			mutual[i].Favorite = containsID(favorites, mutual[i].UserID)
+		}
+		formatter.JSON(w, http.StatusOK, mutual)
+	}
+}
+
+func getIncomingRequestsHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	recipientView := func(request FriendRequest) (FriendRequest, bool) {
+		return request, true
+	}
+	return pendingRequestsHandler(formatter, database, database.getPendingRequestsToUser, recipientView)
+}
+
+func getFollowRequestsHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	recipientView := func(request FriendRequest) (FriendRequest, bool) {
+		return request, true
+	}
+	return pendingRequestsHandler(formatter, database, database.getPendingFollowRequests, recipientView)
+}
+
+func getOutgoingRequestsHandler(formatter *render.Render, database Database, config Config) http.HandlerFunc {
+	list := func(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+		return database.getPendingRequestsFromUser(ctx, userID, time.Now().Add(-config.RejectionCooldown), page)
+	}
+	senderView := func(request FriendRequest) (FriendRequest, bool) {
+		return request.senderView(config.RejectionCooldown, time.Now())
+	}
+	return pendingRequestsHandler(formatter, database, list, senderView)
+}
+
+// pendingRequestsHandler lists a page of requests, passing each through view
+// to decide what the caller gets to see of it.
+func pendingRequestsHandler(formatter *render.Render, database Database,
+	list func(ctx context.Context, userID uint, page Page) ([]FriendRequest, error),
+	view func(request FriendRequest) (FriendRequest, bool)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		page, err := parsePage(req)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, "Invalid page parameters.")
+			return
+		}
+		requests, err := list(ctx, userID, page)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get requests.")
+			return
+		}
+		visible := []FriendRequest{}
+		for _, request := range requests {
+			if request, ok := view(request); ok {
+				visible = append(visible, request)
+			}
+		}
+		formatter.JSON(w, http.StatusOK, RequestsPage{
+			Requests:   visible,
+			NextCursor: page.nextCursor(userID, requests, requestedSince),
+		})
+	}
+}
+
+func postBlockHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
 		userID, err := getUserFromHeader(req, database)
-		if err != nil || userID == uint(0) {
-			formatter.JSON(w, http.StatusForbidden, err)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+
+		var block Block
+		payload, _ := ioutil.ReadAll(req.Body)
+		err = json.Unmarshal(payload, &block)
+		if err != nil || block.BlockedUserID == uint(0) || block.BlockedUserID == userID {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse block.")
+			return
+		}
+
+		existing, err := database.getBlockBetween(ctx, userID, block.BlockedUserID)
+		if err != nil && err != sql.ErrNoRows {
+			storageError(w, formatter, err, "Failed to block user.")
+			return
+		}
+		if err == nil && existing.UserID == userID {
+			formatter.JSON(w, http.StatusBadRequest, "User already blocked.")
 			return
 		}
-		requests, err := database.getFriendsByUserID(userID)
 
+		err = severRelationship(ctx, userID, block.BlockedUserID, database)
 		if err != nil {
-			formatter.JSON(w, http.StatusNotFound, "Failed to get friends.")
+			storageError(w, formatter, err, "Failed to update request.")
 			return
 		}
-		formatter.JSON(w, http.StatusOK, requests)
+		block = BlockUser(userID, block.BlockedUserID)
+		err = database.insertBlock(ctx, block)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to block user.")
+			return
+		}
+		formatter.JSON(w, http.StatusCreated, "User blocked")
+	}
+}
+
+func deleteBlockHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		blockedUserID, err := getUserIDFromVars(req)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "No user id sent.")
+			return
+		}
+		err = database.deleteBlock(ctx, userID, blockedUserID)
+		if err == sql.ErrNoRows {
+			formatter.JSON(w, http.StatusNotFound, "No block found.")
+			return
+		}
+		if err != nil {
+			storageError(w, formatter, err, "Failed to unblock user.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, "User unblocked")
+	}
+}
+
+func getBlocksHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		blocks, err := database.getBlocksInvolvingUser(ctx, userID)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get blocks.")
+			return
+		}
+		// Only show the caller who they blocked, never who blocked them.
+		blocked := []Block{}
+		for _, block := range blocks {
+			if block.UserID == userID {
+				blocked = append(blocked, block)
+			}
+		}
+		formatter.JSON(w, http.StatusOK, blocked)
+	}
+}
+
+func getSettingsHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		settings, err := getSettingsOrDefault(ctx, userID, database)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get settings.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, settings)
+	}
+}
+
+func putSettingsHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+
+		var settings Settings
+		payload, _ := ioutil.ReadAll(req.Body)
+		err = json.Unmarshal(payload, &settings)
+		if err != nil || !settings.valid() {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse settings.")
+			return
+		}
+		settings.UserID = userID
+		err = database.upsertSettings(ctx, settings)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to save settings.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, settings)
+	}
+}
+
+func getSuggestionsHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		limit := defaultSuggestionLimit
+		if raw := req.URL.Query().Get("limit"); raw != "" {
+			limit, err = strconv.Atoi(raw)
+			if err != nil || limit <= 0 || limit > maxSuggestionLimit {
+				formatter.JSON(w, http.StatusBadRequest, "Invalid limit.")
+				return
+			}
+		}
+		suggestions, err := suggestFriends(ctx, userID, limit, database)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get suggestions.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, suggestions)
+	}
+}
+
+func dismissSuggestionHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		dismissedUserID, err := getUserIDFromVars(req)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "No user id sent.")
+			return
+		}
+		err = database.insertDismissedSuggestion(ctx, userID, dismissedUserID)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to dismiss suggestion.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, "Suggestion dismissed")
+	}
+}
+
+func getFriendPathHandler(formatter *render.Render, database Database, config Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		otherID, err := getUserIDFromVars(req)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "No user id sent.")
+			return
+		}
+		maxDepth := config.MaxPathDepth
+		if raw := req.URL.Query().Get("max_depth"); raw != "" {
+			maxDepth, err = strconv.Atoi(raw)
+			if err != nil || maxDepth <= 0 || maxDepth > config.MaxPathDepth {
+				formatter.JSON(w, http.StatusBadRequest, "Invalid max depth.")
+				return
+			}
+		}
+
+		path, err := shortestFriendPath(ctx, userID, otherID, maxDepth, config.MaxPathVisited, database)
+		if err == errNoPath || err == errPathSearchLimit {
+			formatter.JSON(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			storageError(w, formatter, err, "Failed to find path.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, FriendPath{Path: path, Degrees: len(path) - 1})
+	}
+}
+
+func postRelationshipsBatchHandler(formatter *render.Render, database Database, config Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+
+		var batch RelationshipsRequest
+		payload, _ := ioutil.ReadAll(req.Body)
+		err = json.Unmarshal(payload, &batch)
+		if err != nil || len(batch.UserIDs) > maxRelationshipBatch {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse user ids.")
+			return
+		}
+
+		relationships, err := resolveRelationships(ctx, userID, batch.UserIDs, config.RejectionCooldown, database)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get relationships.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, relationships)
+	}
+}
+
+func getCanMessageHandler(formatter *render.Render, database Database, config Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		// The chat service asks about any pair of users with its own
+		// credential. Users may only ask about messages they send, as
+		// decisions give away friendships and privacy settings.
+		service := isServiceToken(req.Header.Get("Authorization"), config.ServiceTokens)
+		var userID uint
+		if !service {
+			var err error
+			if userID, err = getUserFromHeader(req, database); err != nil {
+				authError(w, formatter, err)
+				return
+			}
+		}
+		query := req.URL.Query()
+		from, fromErr := strconv.ParseUint(query.Get("from"), 10, 32)
+		to, toErr := strconv.ParseUint(query.Get("to"), 10, 32)
+		if fromErr != nil || toErr != nil || from == 0 || to == 0 || from == to {
+			formatter.JSON(w, http.StatusBadRequest, "Invalid from or to.")
+			return
+		}
+		if !service && uint(from) != userID {
+			formatter.JSON(w, http.StatusForbidden, "You can only check messages you send.")
+			return
+		}
+
+		decision, err := canMessage(ctx, uint(from), uint(to), config.CanMessageCacheTTL, database)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to decide.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, decision)
+	}
+}
+
+func getFriendListsHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		lists, err := database.getFriendListsByUserID(ctx, userID)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get lists.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, lists)
+	}
+}
+
+func postFriendListHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+
+		var list FriendList
+		payload, _ := ioutil.ReadAll(req.Body)
+		err = json.Unmarshal(payload, &list)
+		if err != nil || !validListName(list.Name) {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse list.")
+			return
+		}
+		taken, err := listNameTaken(ctx, userID, 0, list.Name, database)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get lists.")
+			return
+		}
+		if taken {
+			formatter.JSON(w, http.StatusConflict, "A list with that name already exists.")
+			return
+		}
+
+		list = CreateFriendList(userID, list.Name)
+		list.ID, err = database.insertFriendList(ctx, list)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to create list.")
+			return
+		}
+		formatter.JSON(w, http.StatusCreated, list)
+	}
+}
+
+func getFriendListHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		list, err := getFriendListFromVars(req, userID, database)
+		if err == sql.ErrNoRows {
+			formatter.JSON(w, http.StatusNotFound, "List not found.")
+			return
+		}
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get list.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, list)
+	}
+}
+
+func putFriendListHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		list, err := getFriendListFromVars(req, userID, database)
+		if err == sql.ErrNoRows {
+			formatter.JSON(w, http.StatusNotFound, "List not found.")
+			return
+		}
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get list.")
+			return
+		}
+
+		var update FriendList
+		payload, _ := ioutil.ReadAll(req.Body)
+		err = json.Unmarshal(payload, &update)
+		if err != nil || !validListName(update.Name) {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse list.")
+			return
+		}
+		taken, err := listNameTaken(ctx, userID, list.ID, update.Name, database)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get lists.")
+			return
+		}
+		if taken {
+			formatter.JSON(w, http.StatusConflict, "A list with that name already exists.")
+			return
+		}
+
+		list.Name = strings.TrimSpace(update.Name)
+		err = database.updateFriendList(ctx, list)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to update list.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, list)
+	}
+}
+
+func deleteFriendListHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		list, err := getFriendListFromVars(req, userID, database)
+		if err == sql.ErrNoRows {
+			formatter.JSON(w, http.StatusNotFound, "List not found.")
+			return
+		}
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get list.")
+			return
+		}
+		err = database.deleteFriendList(ctx, list.ID)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to delete list.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, "List deleted")
+	}
+}
+
+func putFriendListMemberHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		list, err := getFriendListFromVars(req, userID, database)
+		if err == sql.ErrNoRows {
+			formatter.JSON(w, http.StatusNotFound, "List not found.")
+			return
+		}
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get list.")
+			return
+		}
+		memberID, err := getUserIDFromVars(req)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "No user id sent.")
+			return
+		}
+
+		request, err := getRequestBetween(ctx, userID, memberID, database)
+		if err != nil && err != sql.ErrNoRows {
+			storageError(w, formatter, err, "Failed to update list.")
+			return
+		}
+		if err != nil || request.Status != StatusAccepted {
+			formatter.JSON(w, http.StatusBadRequest, "Only friends can be added to a list.")
+			return
+		}
+		if !list.hasMember(memberID) {
+			err = database.insertFriendListMember(ctx, list.ID, memberID)
+			if err != nil {
+				storageError(w, formatter, err, "Failed to update list.")
+				return
+			}
+			list.Members = append(list.Members, memberID)
+		}
+		formatter.JSON(w, http.StatusOK, list)
+	}
+}
+
+func deleteFriendListMemberHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		list, err := getFriendListFromVars(req, userID, database)
+		if err == sql.ErrNoRows {
+			formatter.JSON(w, http.StatusNotFound, "List not found.")
+			return
+		}
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get list.")
+			return
+		}
+		memberID, err := getUserIDFromVars(req)
+		if err != nil || !list.hasMember(memberID) {
+			formatter.JSON(w, http.StatusNotFound, "User isn't on this list.")
+			return
+		}
+
+		err = database.deleteFriendListMember(ctx, list.ID, memberID)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to update list.")
+			return
+		}
+		list.removeMember(memberID)
+		formatter.JSON(w, http.StatusOK, list)
+	}
+}
+
+func postFollowHandler(formatter *render.Render, database Database, config Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		followeeID, err := getUserIDFromVars(req)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "No user id sent.")
+			return
+		}
+		if followeeID == userID {
+			formatter.JSON(w, http.StatusBadRequest, "You can't follow yourself.")
+			return
+		}
+
+		block, err := database.getBlockBetween(ctx, userID, followeeID)
+		if err != nil && err != sql.ErrNoRows {
+			storageError(w, formatter, err, "Failed to follow user.")
+			return
+		}
+		if err == nil && block.UserID == userID {
+			formatter.JSON(w, http.StatusForbidden, "You have blocked this user.")
+			return
+		}
+		if err == nil {
+			// Don't let the blocked user find out they were blocked.
+			formatter.JSON(w, http.StatusCreated, "Follow requested")
+			return
+		}
+
+		last, err := database.getFollowRequest(ctx, userID, followeeID)
+		if err != nil && err != sql.ErrNoRows {
+			storageError(w, formatter, err, "Failed to follow user.")
+			return
+		}
+		if err == nil && last.Status == StatusAccepted {
+			formatter.JSON(w, http.StatusBadRequest, "Already following this user.")
+			return
+		}
+		// As with friend requests, a follow waiting for approval and one
+		// rejected during the cooldown get the same answer.
+		pending := err == nil && last.isPending()
+		var wait time.Duration
+		if pending {
+			wait = config.RejectionCooldown
+		} else if err == nil {
+			wait = last.cooldownLeft(config.RejectionCooldown, time.Now())
+		}
+		if pending || wait > 0 {
+			setRetryAfter(w, wait)
+			formatter.JSON(w, http.StatusTooManyRequests, "Please wait before sending another request.")
+			return
+		}
+
+		settings, err := getSettingsOrDefault(ctx, followeeID, database)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to follow user.")
+			return
+		}
+		follow := FollowUser(userID, followeeID, settings.Private)
+		err = database.insertFriendRequest(ctx, follow)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to follow user.")
+			return
+		}
+		if follow.isPending() {
+			formatter.JSON(w, http.StatusCreated, "Follow requested")
+			return
+		}
+		formatter.JSON(w, http.StatusCreated, "Following")
+	}
+}
+
+func deleteFollowHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		followeeID, err := getUserIDFromVars(req)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "No user id sent.")
+			return
+		}
+		err = unfollow(ctx, userID, followeeID, userID, database)
+		if err == errNotFollowing {
+			formatter.JSON(w, http.StatusNotFound, "Not following this user.")
+			return
+		}
+		if err != nil {
+			storageError(w, formatter, err, "Failed to update request.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, "Unfollowed")
+	}
+}
+
+func getFollowersHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return followsHandler(formatter, database, database.getFollowers)
+}
+
+func getFollowingHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return followsHandler(formatter, database, database.getFollowing)
+}
+
+// followsHandler serves a page of the user's followers or followees, as
+// listed by list.
+func followsHandler(formatter *render.Render, database Database,
+	list func(ctx context.Context, userID uint, page Page) ([]FriendRequest, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		userID, err := getUserFromHeader(req, database)
+		if err != nil {
+			authError(w, formatter, err)
+			return
+		}
+		page, err := parsePage(req)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, "Invalid page parameters.")
+			return
+		}
+		requests, err := list(ctx, userID, page)
+		if err != nil {
+			storageError(w, formatter, err, "Failed to get follows.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, FollowsPage{
+			Follows:    followsFromRequests(userID, requests),
+			NextCursor: page.nextCursor(userID, requests, friendsSince),
+		})
+	}
+}
+
+// authError responds to a request whose user couldn't be found from its
+// token: 403 when the token belongs to nobody, otherwise as a storage error.
+func authError(w http.ResponseWriter, formatter *render.Render, err error) {
+	if err == errNoUser {
+		formatter.JSON(w, http.StatusForbidden, "No auth header sent")
+		return
+	}
+	storageError(w, formatter, err, "Failed to find user.")
+}
+
+// setRetryAfter tells the client to wait before trying again, for at least
+// a second.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// storageError responds to a failed database operation: 504 when it ran out
+// of time, otherwise 500 with message.
+func storageError(w http.ResponseWriter, formatter *render.Render, err error, message string) {
+	if err == context.DeadlineExceeded {
+		formatter.JSON(w, http.StatusGatewayTimeout, "Timed out waiting for the database.")
+		return
 	}
+	formatter.JSON(w, http.StatusInternalServerError, message)
 }
@@ -2,11 +2,14 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -19,74 +22,17 @@ var (
 	formatter = render.New(render.Options{
 		IndentJSON: true,
 	})
-	request  *http.Request
-	recorder *httptest.ResponseRecorder
+	request    *http.Request
+	recorder   *httptest.ResponseRecorder
+	testConfig = DefaultConfig()
+	ctx        = context.Background()
 )
 
-type testDatabase struct {
-	requests []FriendRequest
-	redis    map[string]string
-}
-
-func (t *testDatabase) getFriendRequestByUserFromAndTo(userFrom, userTo uint) (FriendRequest, error) {
-	for _, request := range t.requests {
-		if (request.UserFromID == userFrom || request.UserToID == userFrom) &&
-			(request.UserFromID == userTo || request.UserToID == userTo) {
-			return request, nil
-		}
-	}
-
-	return FriendRequest{}, errors.New("No request found")
-}
-
-func (t *testDatabase) insertFriendRequest(request FriendRequest) error {
-	t.requests = append(t.requests, request)
-	return nil
-}
-
-func (t *testDatabase) updateFriendRequest(request FriendRequest) error {
-	for indx, searchedRequest := range t.requests {
-		if (searchedRequest.UserFromID == request.UserFromID ||
-			searchedRequest.UserToID == request.UserFromID) &&
-			(searchedRequest.UserFromID == request.UserToID ||
-				searchedRequest.UserToID == request.UserToID) {
-			t.requests[indx] = request
-			return nil
-		}
-	}
-	return errors.New("Request not found to update")
-}
-func (t *testDatabase) redisGetValue(key string) (string, error) {
-	return t.redis[key], nil
-}
-func (t *testDatabase) redisSetValue(key, value string, seconds time.Duration) error {
-	t.redis[key] = value
-	return nil
-}
-func (t *testDatabase) getFriendRequestByID(requestID uint) (FriendRequest, error) {
-	for _, request := range t.requests {
-		if request.ID == requestID {
-			return request, nil
-		}
-	}
-	return FriendRequest{}, errors.New("Request not found")
-}
-
-func (t *testDatabase) getFriendsByUserID(userID uint) ([]FriendRequest, error) {
-	var requests []FriendRequest
-	for _, request := range t.requests {
-		if request.UserFromID == userID || request.UserToID == userID {
-			requests = append(requests, request)
-		}
-	}
-	return requests, nil
-}
-
 func TestPostAddFriendHandlerWithoutAuthKey(t *testing.T) {
-	database := &testDatabase{}
+	database := newMemoryDatabase()
 
 	client := &http.Client{}
-	server := httptest.NewServer(http.HandlerFunc(postAddFriendHandler(formatter, database)))
+	server := httptest.NewServer(http.HandlerFunc(postAddFriendHandler(formatter, database, testConfig)))
 	defer server.Close()
 
 	body := []byte("this is not valid json")
@@ -110,13 +56,11 @@ func TestPostAddFriendHandlerWithoutAuthKey(t *testing.T) {
 }
 
 func TestPostAddFriendHandlerInvalidJSON(t *testing.T) {
-	database := &testDatabase{}
-	database.redis = make(map[string]string)
-	database.redisSetValue("TEST", "1", time.Since(time.Now()))
+	database := newTokenTestDatabase(map[string]string{"TEST": "1"})
 
 	client := &http.Client{}
 
-	server := httptest.NewServer(http.HandlerFunc(postAddFriendHandler(formatter, database)))
+	server := httptest.NewServer(http.HandlerFunc(postAddFriendHandler(formatter, database, testConfig)))
 	defer server.Close()
 
 	body := []byte("this is not valid json")
@@ -142,13 +86,11 @@ func TestPostAddFriendHandlerInvalidJSON(t *testing.T) {
 }
 
 func TestPostAddFriendHandlerHandlerNotFriendRequest(t *testing.T) {
-	database := &testDatabase{}
-	database.redis = make(map[string]string)
-	database.redisSetValue("TEST", "1", time.Since(time.Now()))
+	database := newTokenTestDatabase(map[string]string{"TEST": "1"})
 
 	client := &http.Client{}
 
-	server := httptest.NewServer(http.HandlerFunc(postAddFriendHandler(formatter, database)))
+	server := httptest.NewServer(http.HandlerFunc(postAddFriendHandler(formatter, database, testConfig)))
 	defer server.Close()
 
 	body := []byte("{\"test\":\"Not comment.\"}")
@@ -161,7 +103,11 @@ func TestPostAddFriendHandlerHandlerNotFriendRequest(t *testing.T) {
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Authorization", "TEST")
 
-	res, _ := client.Do(req)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Errorf("Error in POST to postAddFriendHandler: %v", err)
+		return
+	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusBadRequest {
@@ -170,12 +116,10 @@ func TestPostAddFriendHandlerHandlerNotFriendRequest(t *testing.T) {
 }
 
 func TestPostAddFriendHandlerHandlerSuccess(t *testing.T) {
-	database := &testDatabase{}
-	database.redis = make(map[string]string)
-	database.redisSetValue("TEST", "1", time.Since(time.Now()))
+	database := newTokenTestDatabase(map[string]string{"TEST": "1"})
 
 	client := &http.Client{}
-	server := httptest.NewServer(http.HandlerFunc(postAddFriendHandler(formatter, database)))
+	server := httptest.NewServer(http.HandlerFunc(postAddFriendHandler(formatter, database, testConfig)))
 	defer server.Close()
 
 	body := []byte("{\"user_to_id\": 2}")
@@ -189,7 +133,11 @@ func TestPostAddFriendHandlerHandlerSuccess(t *testing.T) {
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Authorization", "TEST")
 
-	resp, _ := client.Do(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Errorf("Error in POST to postAddFriendHandler: %v", err)
+		return
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusCreated {
@@ -203,27 +151,32 @@ func TestPostAddFriendHandlerHandlerSuccess(t *testing.T) {
 }
 
 func TestRejectRequestHandlerWithoutValidRequest(t *testing.T) {
-	database := &testDatabase{}
+	database := newRequestTestDatabase()
 	server := MakeTestServer(database)
 
-	recorder = httptest.NewRecorder()
-	request, _ = http.NewRequest("PUT", "/friends/1/reject", nil)
-	server.ServeHTTP(recorder, request)
+	recorder = serveTestRequest(server, "PUT", "/friends/5/reject", "RECIPIENT")
 
 	if recorder.Code != http.StatusNotFound {
 		t.Errorf("Expected %v; received %v", http.StatusNotFound, recorder.Code)
 	}
 }
 
-func TestRejectRequestHandlerWithValidRequest(t *testing.T) {
-	database := &testDatabase{}
-	database.insertFriendRequest(FriendRequest{ID: 1, UserFromID: 1, UserToID: 2})
+func TestRejectRequestHandlerWithoutAuth(t *testing.T) {
+	database := newRequestTestDatabase()
+	server := MakeTestServer(database)
+
+	recorder = serveTestRequest(server, "PUT", "/friends/1/reject", "")
+
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+	}
+}
 
+func TestRejectRequestHandlerWithValidRequest(t *testing.T) {
+	database := newRequestTestDatabase()
 	server := MakeTestServer(database)
 
-	recorder = httptest.NewRecorder()
-	request, _ = http.NewRequest("PUT", "/friends/1/reject", nil)
-	server.ServeHTTP(recorder, request)
+	recorder = serveTestRequest(server, "PUT", "/friends/1/reject", "RECIPIENT")
 
 	if recorder.Code != http.StatusOK {
 		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
@@ -234,40 +187,286 @@ func TestRejectRequestHandlerWithValidRequest(t *testing.T) {
 	}
 }
 
+func TestRejectRequestHandlerNotRecipient(t *testing.T) {
+	for _, token := range []string{"SENDER", "OTHER"} {
+		database := newRequestTestDatabase()
+		server := MakeTestServer(database)
+
+		recorder = serveTestRequest(server, "PUT", "/friends/1/reject", token)
+
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("%s: expected %v; received %v", token, http.StatusForbidden, recorder.Code)
+		}
+		if !database.requests[0].RejectedAt.IsZero() {
+			t.Errorf("%s: request should not have been rejected", token)
+		}
+	}
+}
+
 func TestAcceptRequestHandlerWithoutValidRequest(t *testing.T) {
-	database := &testDatabase{}
+	database := newRequestTestDatabase()
 	server := MakeTestServer(database)
 
-	recorder = httptest.NewRecorder()
-	request, _ = http.NewRequest("PUT", "/friends/1/accept", nil)
-	server.ServeHTTP(recorder, request)
+	recorder = serveTestRequest(server, "PUT", "/friends/5/accept", "RECIPIENT")
 
 	if recorder.Code != http.StatusNotFound {
 		t.Errorf("Expected %v; received %v", http.StatusNotFound, recorder.Code)
 	}
 }
 
-func TestAcceptRequestHandlerWithValidRequest(t *testing.T) {
-	database := &testDatabase{}
-	database.insertFriendRequest(FriendRequest{ID: 1, UserFromID: 1, UserToID: 2})
+func TestAcceptRequestHandlerWithoutAuth(t *testing.T) {
+	database := newRequestTestDatabase()
+	server := MakeTestServer(database)
+
+	recorder = serveTestRequest(server, "PUT", "/friends/1/accept", "")
+
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+	}
+}
 
+func TestAcceptRequestHandlerWithValidRequest(t *testing.T) {
+	database := newRequestTestDatabase()
 	server := MakeTestServer(database)
 
-	recorder = httptest.NewRecorder()
-	request, _ = http.NewRequest("PUT", "/friends/1/accept", nil)
-	server.ServeHTTP(recorder, request)
+	recorder = serveTestRequest(server, "PUT", "/friends/1/accept", "RECIPIENT")
 
 	if recorder.Code != http.StatusOK {
 		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
 	}
 
 	if database.requests[0].AcceptedAt.Unix() <= 0 {
-		t.Error("Expected the reqeust to be rejected")
+		t.Error("Expected the reqeust to be accepted")
+	}
+}
+
+func TestAcceptRequestHandlerNotRecipient(t *testing.T) {
+	for _, token := range []string{"SENDER", "OTHER"} {
+		database := newRequestTestDatabase()
+		server := MakeTestServer(database)
+
+		recorder = serveTestRequest(server, "PUT", "/friends/1/accept", token)
+
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("%s: expected %v; received %v", token, http.StatusForbidden, recorder.Code)
+		}
+		if !database.requests[0].AcceptedAt.IsZero() {
+			t.Errorf("%s: request should not have been accepted", token)
+		}
+	}
+}
+
+func TestCancelRequestHandlerWithoutValidRequest(t *testing.T) {
+	database := newRequestTestDatabase()
+	server := MakeTestServer(database)
+
+	recorder = serveTestRequest(server, "DELETE", "/friends/requests/5", "SENDER")
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected %v; received %v", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestCancelRequestHandlerWithoutAuth(t *testing.T) {
+	database := newRequestTestDatabase()
+	server := MakeTestServer(database)
+
+	recorder = serveTestRequest(server, "DELETE", "/friends/requests/1", "")
+
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+	}
+}
+
+func TestCancelRequestHandlerBySender(t *testing.T) {
+	database := newRequestTestDatabase()
+	server := MakeTestServer(database)
+
+	recorder = serveTestRequest(server, "DELETE", "/friends/requests/1", "SENDER")
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	if database.requests[0].CancelledAt.IsZero() {
+		t.Error("Expected the request to be cancelled")
+	}
+}
+
+func TestCancelRequestHandlerNotSender(t *testing.T) {
+	for _, token := range []string{"RECIPIENT", "OTHER"} {
+		database := newRequestTestDatabase()
+		server := MakeTestServer(database)
+
+		recorder = serveTestRequest(server, "DELETE", "/friends/requests/1", token)
+
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("%s: expected %v; received %v", token, http.StatusForbidden, recorder.Code)
+		}
+		if !database.requests[0].CancelledAt.IsZero() {
+			t.Errorf("%s: request should not have been cancelled", token)
+		}
+	}
+}
+
+func TestCancelRequestHandlerAlreadyAccepted(t *testing.T) {
+	database := newRequestTestDatabase()
+	database.requests[0].accept()
+	server := MakeTestServer(database)
+
+	recorder = serveTestRequest(server, "DELETE", "/friends/requests/1", "SENDER")
+
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected %v; received %v", http.StatusConflict, recorder.Code)
+	}
+	if database.requests[0].Status != StatusAccepted {
+		t.Errorf("Expected status %s; received %s", StatusAccepted, database.requests[0].Status)
+	}
+}
+
+func TestUnfriendHandlerEitherSide(t *testing.T) {
+	for token, url := range map[string]string{
+		"SENDER":    "/friends/2",
+		"RECIPIENT": "/friends/1",
+	} {
+		database := newRequestTestDatabase()
+		database.requests[0].accept()
+		server := MakeTestServer(database)
+
+		recorder = serveTestRequest(server, "DELETE", url, token)
+
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s: expected %v; received %v", token, http.StatusOK, recorder.Code)
+		}
+		ended := database.requests[0]
+		if ended.Status != StatusUnfriended || ended.EndedAt.IsZero() ||
+			ended.EndedBy != requestUserID(database, token) {
+			t.Errorf("%s: expected the friendship to be ended by the caller, got %+v", token, ended)
+		}
+		friends, _ := database.getFriendsByUserID(ctx, 1, defaultPage())
+		if len(friends) != 0 {
+			t.Errorf("%s: expected no friends after unfriending, got %d", token, len(friends))
+		}
+	}
+}
+
+func TestUnfriendHandlerWithoutFriendship(t *testing.T) {
+	database := newRequestTestDatabase()
+	server := MakeTestServer(database)
+
+	recorder = serveTestRequest(server, "DELETE", "/friends/2", "SENDER")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Pending request: expected %v; received %v", http.StatusNotFound, recorder.Code)
+	}
+
+	database.requests[0].accept()
+	recorder = serveTestRequest(server, "DELETE", "/friends/2", "OTHER")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Unrelated user: expected %v; received %v", http.StatusNotFound, recorder.Code)
+	}
+	if database.requests[0].Status != StatusAccepted {
+		t.Error("Friendship should not have been ended by an unrelated user")
+	}
+}
+
+func TestUnfriendHandlerWithoutAuth(t *testing.T) {
+	database := newRequestTestDatabase()
+	database.requests[0].accept()
+	server := MakeTestServer(database)
+
+	recorder = serveTestRequest(server, "DELETE", "/friends/2", "")
+
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+	}
+}
+
+func TestPostAddFriendHandlerAfterUnfriend(t *testing.T) {
+	for _, test := range []struct {
+		token    string
+		from, to uint
+	}{
+		{"SENDER", 1, 2},
+		{"RECIPIENT", 2, 1},
+	} {
+		database := newRequestTestDatabase()
+		server := MakeTestServer(database)
+		serveTestRequest(server, "PUT", "/friends/1/accept", "RECIPIENT")
+		recorder = serveTestRequest(server, "DELETE", "/friends/2", "SENDER")
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Expected %v unfriending; received %v", http.StatusOK, recorder.Code)
+		}
+
+		body := fmt.Sprintf("{\"user_to_id\": %d}", test.to)
+		recorder = serveTestJSON(server, "POST", "/friends/request", test.token, body)
+		if recorder.Code != http.StatusCreated {
+			t.Errorf("%s: Expected %v; received %v", test.token, http.StatusCreated, recorder.Code)
+		}
+		request, err := database.getFriendRequestByUserFromAndTo(ctx, test.from, test.to)
+		if err != nil || request.Status != StatusPending || len(database.requests) != 2 {
+			t.Errorf("%s: Expected a new pending request, got %+v (%v)", test.token, request, err)
+		}
+	}
+}
+
+func TestAcceptRequestHandlerTwice(t *testing.T) {
+	database := newRequestTestDatabase()
+	server := MakeTestServer(database)
+
+	recorder = serveTestRequest(server, "PUT", "/friends/1/accept", "RECIPIENT")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+
+	recorder = serveTestRequest(server, "PUT", "/friends/1/accept", "RECIPIENT")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected %v; received %v", http.StatusConflict, recorder.Code)
+	}
+}
+
+func TestRejectRequestHandlerAfterAccept(t *testing.T) {
+	database := newRequestTestDatabase()
+	server := MakeTestServer(database)
+
+	recorder = serveTestRequest(server, "PUT", "/friends/1/accept", "RECIPIENT")
+	recorder = serveTestRequest(server, "PUT", "/friends/1/reject", "RECIPIENT")
+
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected %v; received %v", http.StatusConflict, recorder.Code)
+	}
+	if !database.requests[0].RejectedAt.IsZero() {
+		t.Error("An accepted request should not be rejected")
+	}
+}
+
+func TestPostAddFriendHandlerExistingRequest(t *testing.T) {
+	for status, expected := range map[string]int{
+		StatusPending:   http.StatusTooManyRequests,
+		StatusAccepted:  http.StatusBadRequest,
+		StatusCancelled: http.StatusCreated,
+	} {
+		database := newRequestTestDatabase()
+		database.requests[0].Status = status
+		server := httptest.NewServer(http.HandlerFunc(postAddFriendHandler(formatter, database, testConfig)))
+
+		req, _ := http.NewRequest("POST", server.URL, bytes.NewBufferString("{\"user_to_id\": 2}"))
+		req.Header.Add("Authorization", "SENDER")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("Error in POST to postAddFriendHandler: %v", err)
+			server.Close()
+			continue
+		}
+		resp.Body.Close()
+		server.Close()
+
+		if resp.StatusCode != expected {
+			t.Errorf("%s: expected %v; received %v", status, expected, resp.StatusCode)
+		}
 	}
 }
 
 func TestGetFriendsHandlerWithoutValidToken(t *testing.T) {
-	database := &testDatabase{}
+	database := newMemoryDatabase()
 
 	client := &http.Client{}
 	server := httptest.NewServer(http.HandlerFunc(getFriendsHandler(formatter, database)))
@@ -287,15 +486,14 @@ func TestGetFriendsHandlerWithoutValidToken(t *testing.T) {
 }
 
 func TestGetFriendsHandlerWithoutAnyFriends(t *testing.T) {
-	var friendRequests []FriendRequest
+	var friendsPage FriendsPage
 
-	database := &testDatabase{}
-	database.redis = make(map[string]string)
-	database.redisSetValue("TEST", "1", time.Since(time.Now()))
+	database := newTokenTestDatabase(map[string]string{"TEST": "1"})
 
-	database.insertFriendRequest(FriendRequest{
+	database.insertFriendRequest(ctx, FriendRequest{
 		UserFromID: 2,
 		UserToID:   3,
+		Status:     StatusAccepted,
 		AcceptedAt: time.Now(),
 	})
 
@@ -313,7 +511,8 @@ func TestGetFriendsHandlerWithoutAnyFriends(t *testing.T) {
 
 	defer resp.Body.Close()
 	payload, _ := ioutil.ReadAll(resp.Body)
-	json.Unmarshal(payload, &friendRequests)
+	json.Unmarshal(payload, &friendsPage)
+	friendRequests := friendsPage.Friends
 	if resp.StatusCode != http.StatusOK {
 		t.Errorf("Expected %v; received %v", http.StatusOK, resp.StatusCode)
 	}
@@ -324,27 +523,28 @@ func TestGetFriendsHandlerWithoutAnyFriends(t *testing.T) {
 }
 
 func TestGetFriendsHandlerWithFriends(t *testing.T) {
-	var friendRequests []FriendRequest
+	var friendsPage FriendsPage
 
-	database := &testDatabase{}
-	database.redis = make(map[string]string)
-	database.redisSetValue("TEST", "1", time.Since(time.Now()))
+	database := newTokenTestDatabase(map[string]string{"TEST": "1"})
 
-	database.insertFriendRequest(FriendRequest{
+	database.insertFriendRequest(ctx, FriendRequest{
 		UserFromID: 2,
 		UserToID:   3,
+		Status:     StatusAccepted,
 		AcceptedAt: time.Now(),
 	})
 
-	database.insertFriendRequest(FriendRequest{
+	database.insertFriendRequest(ctx, FriendRequest{
 		UserFromID: 1,
 		UserToID:   3,
+		Status:     StatusAccepted,
 		AcceptedAt: time.Now(),
 	})
 
-	database.insertFriendRequest(FriendRequest{
+	database.insertFriendRequest(ctx, FriendRequest{
 		UserFromID: 1,
 		UserToID:   2,
+		Status:     StatusAccepted,
 		AcceptedAt: time.Now(),
 	})
 
@@ -362,7 +562,8 @@ func TestGetFriendsHandlerWithFriends(t *testing.T) {
 
 	defer resp.Body.Close()
 	payload, _ := ioutil.ReadAll(resp.Body)
-	json.Unmarshal(payload, &friendRequests)
+	json.Unmarshal(payload, &friendsPage)
+	friendRequests := friendsPage.Friends
 	if resp.StatusCode != http.StatusOK {
 		t.Errorf("Expected %v; received %v", http.StatusOK, resp.StatusCode)
 	}
@@ -370,12 +571,1020 @@ func TestGetFriendsHandlerWithFriends(t *testing.T) {
 	if len(friendRequests) != 2 {
 		t.Errorf("Expected length to be 2 but instead got %d", len(friendRequests))
 	}
+	for _, friend := range friendRequests {
+		if friend.UserID != 2 && friend.UserID != 3 {
+			t.Errorf("Expected friends 2 and 3, got %d", friend.UserID)
+		}
+	}
+}
+
+func TestGetFriendsHandlerFriendFields(t *testing.T) {
+	var friendsPage FriendsPage
+
+	database := newRequestTestDatabase()
+	database.requests[0].accept()
+	server := MakeTestServer(database)
+
+	recorder = serveTestRequest(server, "GET", "/friends", "RECIPIENT")
+	json.Unmarshal(recorder.Body.Bytes(), &friendsPage)
+	friends := friendsPage.Friends
+
+	if len(friends) != 1 {
+		t.Fatalf("Expected one friend, got %d", len(friends))
+	}
+	if friends[0].UserID != 1 || friends[0].RequestID != 1 ||
+		!friends[0].FriendsSince.Equal(database.requests[0].AcceptedAt) {
+		t.Errorf("Unexpected friend %+v", friends[0])
+	}
+}
+
+func TestGetFriendsHandlerLegacyFormat(t *testing.T) {
+	var requests []FriendRequest
+
+	database := newRequestTestDatabase()
+	database.requests[0].accept()
+	server := MakeTestServer(database)
+
+	recorder = serveTestRequest(server, "GET", "/friends?format=requests", "RECIPIENT")
+	json.Unmarshal(recorder.Body.Bytes(), &requests)
+
+	if len(requests) != 1 || requests[0].UserFromID != 1 || requests[0].UserToID != 2 {
+		t.Errorf("Expected the raw request row, got %+v", requests)
+	}
+}
+
+// newTokenTestDatabase returns an empty database that knows the given auth
+// tokens, mapped to the ids of the users they belong to.
+func newTokenTestDatabase(tokens map[string]string) *memoryDatabase {
+	database := newMemoryDatabase()
+	for token, userID := range tokens {
+		database.redisSetValue(ctx, token, userID, 0)
+	}
+	return database
+}
+
+// newRequestTestDatabase returns a database holding a single pending request
+// from user 1 (SENDER) to user 2 (RECIPIENT); user 3 (OTHER) is unrelated.
+func newRequestTestDatabase() *memoryDatabase {
+	database := newTokenTestDatabase(map[string]string{
+		"SENDER":    "1",
+		"RECIPIENT": "2",
+		"OTHER":     "3",
+	})
+	database.insertFriendRequest(ctx, FriendRequest{ID: 1, UserFromID: 1, UserToID: 2, Status: StatusPending})
+	return database
+}
+
+// requestUserID returns the id of the user token belongs to.
+func requestUserID(database Database, token string) uint {
+	user, _ := database.redisGetValue(ctx, token)
+	userID, _ := strconv.ParseUint(user, 10, 32)
+	return uint(userID)
+}
+
+func serveTestRequest(server http.Handler, method, url, token string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest(method, url, nil)
+	if token != "" {
+		request.Header.Add("Authorization", token)
+	}
+	server.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func serveTestJSON(server http.Handler, method, url, token, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	request.Header.Add("Content-Type", "application/json")
+	if token != "" {
+		request.Header.Add("Authorization", token)
+	}
+	server.ServeHTTP(recorder, request)
+	return recorder
 }
 
-func MakeTestServer(database *testDatabase) *negroni.Negroni {
+func MakeTestServer(database Database) *negroni.Negroni {
 	server := negroni.New()
 	mx := mux.NewRouter()
-	initRoutes(mx, formatter, database)
+	initRoutes(mx, formatter, database, testConfig)
 	server.UseHandler(mx)
 	return server
 }
+
+func TestPostBlockHandlerCancelsPendingRequest(t *testing.T) {
+	for _, token := range []string{"SENDER", "RECIPIENT"} {
+		database := newRequestTestDatabase()
+		server := MakeTestServer(database)
+		other := database.requests[0].friendID(requestUserID(database, token))
+
+		recorder = serveTestJSON(server, "POST", "/blocks", token,
+			fmt.Sprintf("{\"blocked_user_id\": %d}", other))
+
+		if recorder.Code != http.StatusCreated {
+			t.Errorf("%s: expected %v; received %v", token, http.StatusCreated, recorder.Code)
+		}
+		if database.requests[0].Status != StatusCancelled {
+			t.Errorf("%s: expected pending request to be cancelled, got %s", token, database.requests[0].Status)
+		}
+		if len(database.blocks) != 1 {
+			t.Errorf("%s: expected the block to be stored", token)
+		}
+	}
+}
+
+func TestPostBlockHandlerEndsFriendship(t *testing.T) {
+	database := newRequestTestDatabase()
+	database.requests[0].accept()
+	server := MakeTestServer(database)
+
+	recorder = serveTestJSON(server, "POST", "/blocks", "RECIPIENT", "{\"blocked_user_id\": 1}")
+
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected %v; received %v", http.StatusCreated, recorder.Code)
+	}
+	if database.requests[0].Status != StatusUnfriended || database.requests[0].EndedBy != 2 {
+		t.Errorf("Expected friendship to be ended by the blocker, got %+v", database.requests[0])
+	}
+}
+
+func TestPostBlockHandlerInvalid(t *testing.T) {
+	database := newRequestTestDatabase()
+	server := MakeTestServer(database)
+
+	for _, body := range []string{"not json", "{}", "{\"blocked_user_id\": 1}"} {
+		recorder = serveTestJSON(server, "POST", "/blocks", "SENDER", body)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %v; received %v", body, http.StatusBadRequest, recorder.Code)
+		}
+	}
+
+	serveTestJSON(server, "POST", "/blocks", "SENDER", "{\"blocked_user_id\": 3}")
+	recorder = serveTestJSON(server, "POST", "/blocks", "SENDER", "{\"blocked_user_id\": 3}")
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Blocking twice: expected %v; received %v", http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestPostAddFriendHandlerBlocked(t *testing.T) {
+	database := newRequestTestDatabase()
+	database.requests = nil
+	database.insertBlock(ctx, BlockUser(2, 1))
+	server := MakeTestServer(database)
+
+	recorder = serveTestJSON(server, "POST", "/friends/request", "SENDER", "{\"user_to_id\": 2}")
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Blocked user: expected %v; received %v", http.StatusCreated, recorder.Code)
+	}
+
+	recorder = serveTestJSON(server, "POST", "/friends/request", "RECIPIENT", "{\"user_to_id\": 1}")
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Blocker: expected %v; received %v", http.StatusForbidden, recorder.Code)
+	}
+
+	if len(database.requests) != 0 {
+		t.Errorf("Expected no requests between blocked users, got %d", len(database.requests))
+	}
+}
+
+func TestGetBlocksHandlerOnlyShowsOwnBlocks(t *testing.T) {
+	var blocks []Block
+
+	database := newRequestTestDatabase()
+	database.insertBlock(ctx, BlockUser(1, 3))
+	database.insertBlock(ctx, BlockUser(2, 1))
+	server := MakeTestServer(database)
+
+	recorder = serveTestRequest(server, "GET", "/blocks", "SENDER")
+	json.Unmarshal(recorder.Body.Bytes(), &blocks)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	if len(blocks) != 1 || blocks[0].BlockedUserID != 3 {
+		t.Errorf("Expected only the caller's block, got %+v", blocks)
+	}
+}
+
+func TestDeleteBlockHandler(t *testing.T) {
+	database := newRequestTestDatabase()
+	database.insertBlock(ctx, BlockUser(2, 1))
+	server := MakeTestServer(database)
+
+	recorder = serveTestRequest(server, "DELETE", "/blocks/2", "SENDER")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Blocked user unblocking: expected %v; received %v", http.StatusNotFound, recorder.Code)
+	}
+
+	recorder = serveTestRequest(server, "DELETE", "/blocks/1", "RECIPIENT")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	if len(database.blocks) != 0 {
+		t.Error("Expected the block to be removed")
+	}
+}
+
+func TestPendingRequestsHandlers(t *testing.T) {
+	database := newRequestTestDatabase()
+	database.requests[0].CreatedAt = time.Now().Add(-time.Hour)
+	database.insertFriendRequest(ctx, FriendRequest{ID: 2, UserFromID: 3, UserToID: 2, Status: StatusPending,
+		CreatedAt: time.Now()})
+	database.insertFriendRequest(ctx, FriendRequest{ID: 3, UserFromID: 1, UserToID: 3, Status: StatusAccepted})
+	database.insertFriendRequest(ctx, FriendRequest{ID: 4, UserFromID: 3, UserToID: 1, Status: StatusRejected})
+	server := MakeTestServer(database)
+
+	for _, tc := range []struct {
+		url   string
+		token string
+		ids   []uint
+	}{
+		{"/friends/requests/incoming", "RECIPIENT", []uint{2, 1}},
+		{"/friends/requests/outgoing", "RECIPIENT", []uint{}},
+		{"/friends/requests/incoming", "SENDER", []uint{}},
+		{"/friends/requests/outgoing", "SENDER", []uint{1}},
+		{"/friends/requests/outgoing", "OTHER", []uint{2}},
+	} {
+		var requestsPage RequestsPage
+		recorder = serveTestRequest(server, "GET", tc.url, tc.token)
+		json.Unmarshal(recorder.Body.Bytes(), &requestsPage)
+		requests := requestsPage.Requests
+
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s %s: expected %v; received %v", tc.token, tc.url, http.StatusOK, recorder.Code)
+			continue
+		}
+		if len(requests) != len(tc.ids) {
+			t.Errorf("%s %s: expected %d requests, got %d", tc.token, tc.url, len(tc.ids), len(requests))
+			continue
+		}
+		for i, request := range requests {
+			if request.ID != tc.ids[i] {
+				t.Errorf("%s %s: expected request %d at %d, got %d", tc.token, tc.url, tc.ids[i], i, request.ID)
+			}
+		}
+	}
+}
+
+func TestPendingRequestsHandlersWithoutAuth(t *testing.T) {
+	database := newRequestTestDatabase()
+	server := MakeTestServer(database)
+
+	for _, url := range []string{"/friends/requests/incoming", "/friends/requests/outgoing"} {
+		recorder = serveTestRequest(server, "GET", url, "")
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("%s: expected %v; received %v", url, http.StatusForbidden, recorder.Code)
+		}
+	}
+}
+
+func TestPostAddFriendHandlerCrossedRequest(t *testing.T) {
+	var friend Friend
+
+	database := newRequestTestDatabase()
+	server := MakeTestServer(database)
+
+	recorder = serveTestJSON(server, "POST", "/friends/request", "RECIPIENT", "{\"user_to_id\": 1}")
+	json.Unmarshal(recorder.Body.Bytes(), &friend)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	if len(database.requests) != 1 || database.requests[0].Status != StatusAccepted {
+		t.Errorf("Expected the crossed request to be accepted, got %+v", database.requests)
+	}
+	if friend.UserID != 1 || friend.RequestID != 1 || friend.FriendsSince.IsZero() {
+		t.Errorf("Expected the new friendship in the response, got %+v", friend)
+	}
+}
+
+func TestPostAddFriendHandlerSameDirectionPending(t *testing.T) {
+	database := newRequestTestDatabase()
+	server := MakeTestServer(database)
+
+	recorder = serveTestJSON(server, "POST", "/friends/request", "SENDER", "{\"user_to_id\": 2}")
+
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected %v; received %v", http.StatusTooManyRequests, recorder.Code)
+	}
+	if database.requests[0].Status != StatusPending {
+		t.Error("The sender must not be able to accept their own request")
+	}
+}
+
+func TestPostAddFriendHandlerPendingWithoutCooldown(t *testing.T) {
+	database := newRequestTestDatabase()
+	config := testConfig
+	config.RejectionCooldown = 0
+	server := httptest.NewServer(http.HandlerFunc(postAddFriendHandler(formatter, database, config)))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL, bytes.NewBufferString("{\"user_to_id\": 2}"))
+	req.Header.Set("Authorization", "SENDER")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") != "1" {
+		t.Errorf("Expected %v after 1s; received %v after %q", http.StatusTooManyRequests,
+			res.StatusCode, res.Header.Get("Retry-After"))
+	}
+	if len(database.requests) != 1 {
+		t.Errorf("Expected no second pending request, got %+v", database.requests)
+	}
+}
+
+func TestPostAddFriendHandlerToSelf(t *testing.T) {
+	database := newRequestTestDatabase()
+	server := MakeTestServer(database)
+
+	for i := 0; i < 2; i++ {
+		recorder = serveTestJSON(server, "POST", "/friends/request", "SENDER", "{\"user_to_id\": 1}")
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("Expected %v; received %v", http.StatusBadRequest, recorder.Code)
+		}
+	}
+	if len(database.requests) != 1 {
+		t.Errorf("No request to yourself should be added, got %+v", database.requests)
+	}
+}
+
+func TestGetRequestBetweenEitherDirection(t *testing.T) {
+	database := newRequestTestDatabase()
+	database.requests[0].CreatedAt = time.Now().Add(-time.Hour)
+	database.requests[0].reject()
+	database.insertFriendRequest(ctx, FriendRequest{ID: 2, UserFromID: 2, UserToID: 1,
+		Status: StatusPending, CreatedAt: time.Now()})
+
+	for _, pair := range [][2]uint{{1, 2}, {2, 1}} {
+		request, err := getRequestBetween(ctx, pair[0], pair[1], database)
+		if err != nil || request.ID != 2 {
+			t.Errorf("%v: expected the latest request, got %+v (%v)", pair, request, err)
+		}
+	}
+	if _, err := getRequestBetween(ctx, 1, 3, database); err == nil {
+		t.Error("Expected no request between unrelated users")
+	}
+}
+
+func TestPostAddFriendHandlerRejectionCooldown(t *testing.T) {
+	database := newRequestTestDatabase()
+	database.requests[0].reject()
+	server := MakeTestServer(database)
+
+	recorder = serveTestJSON(server, "POST", "/friends/request", "SENDER", "{\"user_to_id\": 2}")
+
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected %v; received %v", http.StatusTooManyRequests, recorder.Code)
+	}
+	retryAfter, err := strconv.Atoi(recorder.Header().Get("Retry-After"))
+	left := database.requests[0].cooldownLeft(testConfig.RejectionCooldown, time.Now())
+	if err != nil || retryAfter < int(left.Seconds()) || retryAfter > int(testConfig.RejectionCooldown.Seconds()) {
+		t.Errorf("Expected Retry-After at the end of the cooldown, got %q", recorder.Header().Get("Retry-After"))
+	}
+
+	// The sender can't tell the rejection apart from a request still pending.
+	pending := serveTestJSON(MakeTestServer(newRequestTestDatabase()), "POST", "/friends/request",
+		"SENDER", "{\"user_to_id\": 2}")
+	if recorder.Code != pending.Code || recorder.Body.String() != pending.Body.String() {
+		t.Errorf("Expected %v %q; received %v %q", pending.Code, pending.Body.String(),
+			recorder.Code, recorder.Body.String())
+	}
+	if pending.Header().Get("Retry-After") != strconv.Itoa(int(testConfig.RejectionCooldown.Seconds())) {
+		t.Errorf("Expected a pending request to wait a whole cooldown, got %q", pending.Header().Get("Retry-After"))
+	}
+	if len(database.requests) != 1 {
+		t.Error("No request should be added during the cooldown")
+	}
+
+	// The recipient isn't held to the sender's cooldown.
+	recorder = serveTestJSON(server, "POST", "/friends/request", "RECIPIENT", "{\"user_to_id\": 1}")
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Recipient: expected %v; received %v", http.StatusCreated, recorder.Code)
+	}
+}
+
+func TestPostAddFriendHandlerAfterCooldown(t *testing.T) {
+	database := newRequestTestDatabase()
+	database.requests[0].reject()
+	database.requests[0].RejectedAt = time.Now().Add(-testConfig.RejectionCooldown - time.Minute)
+	server := MakeTestServer(database)
+
+	recorder = serveTestJSON(server, "POST", "/friends/request", "SENDER", "{\"user_to_id\": 2}")
+
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected %v; received %v", http.StatusCreated, recorder.Code)
+	}
+}
+
+func TestOutgoingRequestsHideRejection(t *testing.T) {
+	database := newRequestTestDatabase()
+	database.requests[0].reject()
+	database.insertFriendRequest(ctx, FriendRequest{ID: 2, UserFromID: 1, UserToID: 3, Status: StatusRejected,
+		RejectedAt: time.Now().Add(-testConfig.RejectionCooldown - time.Minute)})
+	server := MakeTestServer(database)
+
+	var outgoing RequestsPage
+	recorder = serveTestRequest(server, "GET", "/friends/requests/outgoing", "SENDER")
+	json.Unmarshal(recorder.Body.Bytes(), &outgoing)
+
+	if len(outgoing.Requests) != 1 {
+		t.Fatalf("Expected only the rejection still in its cooldown, got %+v", outgoing.Requests)
+	}
+	if outgoing.Requests[0].Status != StatusPending || !outgoing.Requests[0].RejectedAt.IsZero() {
+		t.Errorf("Expected the rejection to look pending to the sender, got %+v", outgoing.Requests[0])
+	}
+
+	var incoming RequestsPage
+	recorder = serveTestRequest(server, "GET", "/friends/requests/incoming", "RECIPIENT")
+	json.Unmarshal(recorder.Body.Bytes(), &incoming)
+
+	if len(incoming.Requests) != 0 {
+		t.Errorf("Expected the recipient's inbox to be empty, got %+v", incoming.Requests)
+	}
+}
+
+func TestOutgoingRequestsPageSkipsOldRejections(t *testing.T) {
+	database := newRequestTestDatabase()
+	database.requests[0].CreatedAt = time.Now().Add(-time.Hour)
+	database.insertFriendRequest(ctx, FriendRequest{ID: 2, UserFromID: 1, UserToID: 3, Status: StatusRejected,
+		CreatedAt: time.Now(), RejectedAt: time.Now().Add(-testConfig.RejectionCooldown - time.Minute)})
+	server := MakeTestServer(database)
+
+	var outgoing RequestsPage
+	recorder = serveTestRequest(server, "GET", "/friends/requests/outgoing?limit=1", "SENDER")
+	json.Unmarshal(recorder.Body.Bytes(), &outgoing)
+
+	if len(outgoing.Requests) != 1 || outgoing.Requests[0].ID != 1 {
+		t.Errorf("Expected the pending request on the first page, got %+v", outgoing.Requests)
+	}
+}
+
+func TestSettingsHandlers(t *testing.T) {
+	var settings Settings
+
+	database := newRequestTestDatabase()
+	server := MakeTestServer(database)
+
+	recorder = serveTestRequest(server, "GET", "/friends/settings", "RECIPIENT")
+	json.Unmarshal(recorder.Body.Bytes(), &settings)
+	if recorder.Code != http.StatusOK || settings.AllowRequestsFrom != AllowEveryone {
+		t.Errorf("Expected default settings, got %v %+v", recorder.Code, settings)
+	}
+
+	recorder = serveTestJSON(server, "PUT", "/friends/settings", "RECIPIENT",
+		"{\"allow_requests_from\": \"nobody\", \"user_id\": 1}")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	if database.settings[2].AllowRequestsFrom != AllowNobody {
+		t.Error("Expected the caller's settings to be saved")
+	}
+	if _, ok := database.settings[1]; ok {
+		t.Error("Settings must only be saved for the caller")
+	}
+
+	for _, body := range []string{"not json", "{}", "{\"allow_requests_from\": \"anyone\"}"} {
+		recorder = serveTestJSON(server, "PUT", "/friends/settings", "RECIPIENT", body)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %v; received %v", body, http.StatusBadRequest, recorder.Code)
+		}
+	}
+}
+
+func TestPostAddFriendHandlerPrivacySettings(t *testing.T) {
+	for allow, expected := range map[string]int{
+		AllowEveryone:         http.StatusCreated,
+		AllowFriendsOfFriends: http.StatusForbidden,
+		AllowNobody:           http.StatusForbidden,
+	} {
+		database := newRequestTestDatabase()
+		database.requests = nil
+		database.upsertSettings(ctx, Settings{UserID: 3, AllowRequestsFrom: allow})
+		server := MakeTestServer(database)
+
+		recorder = serveTestJSON(server, "POST", "/friends/request", "SENDER", "{\"user_to_id\": 3}")
+
+		if recorder.Code != expected {
+			t.Errorf("%s: expected %v; received %v", allow, expected, recorder.Code)
+		}
+	}
+}
+
+func TestPostAddFriendHandlerFriendsOfFriends(t *testing.T) {
+	database := newRequestTestDatabase()
+	database.requests[0].accept()
+	database.insertFriendRequest(ctx, FriendRequest{ID: 2, UserFromID: 3, UserToID: 2, Status: StatusAccepted})
+	database.insertFriendRequest(ctx, FriendRequest{ID: 3, UserFromID: 4, UserToID: 3, Status: StatusAccepted})
+	database.upsertSettings(ctx, Settings{UserID: 3, AllowRequestsFrom: AllowFriendsOfFriends})
+	server := MakeTestServer(database)
+
+	recorder = serveTestJSON(server, "POST", "/friends/request", "SENDER", "{\"user_to_id\": 3}")
+
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected %v; received %v", http.StatusCreated, recorder.Code)
+	}
+}
+
+// newGraphTestDatabase builds this friendship graph, where every user n can
+// authenticate with the token "Un":
+//
+//	1 - 2, 1 - 3, 1 - 4, 2 - 3, 2 - 5, 3 - 5, 4 - 6, 5 - 7
+func newGraphTestDatabase() *memoryDatabase {
+	database := newMemoryDatabase()
+	for id := 1; id <= 8; id++ {
+		database.redisSetValue(ctx, fmt.Sprintf("U%d", id), strconv.Itoa(id), 0)
+	}
+	edges := [][2]uint{{1, 2}, {1, 3}, {1, 4}, {2, 3}, {2, 5}, {3, 5}, {4, 6}, {5, 7}}
+	for i, edge := range edges {
+		database.insertFriendRequest(ctx, FriendRequest{
+			ID:         uint(i + 1),
+			UserFromID: edge[0],
+			UserToID:   edge[1],
+			Status:     StatusAccepted,
+			AcceptedAt: time.Now().Add(-time.Duration(i) * time.Hour),
+		})
+	}
+	return database
+}
+
+func TestMutualFriendsHandler(t *testing.T) {
+	server := MakeTestServer(newGraphTestDatabase())
+
+	for url, expected := range map[string][]uint{
+		"/friends/5/mutual": {2, 3},
+		"/friends/2/mutual": {3},
+		"/friends/7/mutual": {},
+	} {
+		var mutual []Friend
+		recorder = serveTestRequest(server, "GET", url, "U1")
+		json.Unmarshal(recorder.Body.Bytes(), &mutual)
+
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s: expected %v; received %v", url, http.StatusOK, recorder.Code)
+		}
+		if len(mutual) != len(expected) {
+			t.Errorf("%s: expected %v, got %+v", url, expected, mutual)
+			continue
+		}
+		for i, friend := range mutual {
+			if friend.UserID != expected[i] || friend.RequestID == 0 {
+				t.Errorf("%s: expected %v, got %+v", url, expected, mutual)
+			}
+		}
+	}
+
+	recorder = serveTestRequest(server, "GET", "/friends/1/mutual", "U1")
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Self: expected %v; received %v", http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestGetFriendsHandlerMutualCount(t *testing.T) {
+	var friendsPage FriendsPage
+
+	server := MakeTestServer(newGraphTestDatabase())
+	recorder = serveTestRequest(server, "GET", "/friends?sort=user_id", "U1")
+	json.Unmarshal(recorder.Body.Bytes(), &friendsPage)
+
+	expected := map[uint]int{2: 1, 3: 1, 4: 0}
+	if len(friendsPage.Friends) != len(expected) {
+		t.Fatalf("Expected %d friends, got %+v", len(expected), friendsPage.Friends)
+	}
+	for _, friend := range friendsPage.Friends {
+		if friend.MutualCount != expected[friend.UserID] {
+			t.Errorf("Friend %d: expected %d mutual friends, got %d",
+				friend.UserID, expected[friend.UserID], friend.MutualCount)
+		}
+	}
+}
+
+func createTestFriendList(t *testing.T, server http.Handler, token, name string) FriendList {
+	var list FriendList
+	recorder = serveTestJSON(server, "POST", "/friends/lists", token,
+		fmt.Sprintf("{\"name\": %q}", name))
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected %v; received %v", http.StatusCreated, recorder.Code)
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &list)
+	return list
+}
+
+func TestFriendListHandlers(t *testing.T) {
+	database := newGraphTestDatabase()
+	server := MakeTestServer(database)
+
+	work := createTestFriendList(t, server, "U1", " Work ")
+	if work.ID == 0 || work.Name != "Work" || work.UserID != 1 || len(work.Members) != 0 {
+		t.Errorf("unexpected list %+v", work)
+	}
+	family := createTestFriendList(t, server, "U1", "Family")
+
+	recorder = serveTestJSON(server, "POST", "/friends/lists", "U1", "{\"name\": \"work\"}")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("expected %v for a duplicate name; received %v", http.StatusConflict, recorder.Code)
+	}
+	recorder = serveTestJSON(server, "POST", "/friends/lists", "U1", "{\"name\": \" \"}")
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected %v for a blank name; received %v", http.StatusBadRequest, recorder.Code)
+	}
+
+	recorder = serveTestJSON(server, "PUT", fmt.Sprintf("/friends/lists/%d", family.ID), "U1",
+		"{\"name\": \"Work\"}")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("expected %v renaming onto another list; received %v", http.StatusConflict, recorder.Code)
+	}
+	recorder = serveTestJSON(server, "PUT", fmt.Sprintf("/friends/lists/%d", family.ID), "U1",
+		"{\"name\": \"Relatives\"}")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+
+	var lists []FriendList
+	recorder = serveTestRequest(server, "GET", "/friends/lists", "U1")
+	json.Unmarshal(recorder.Body.Bytes(), &lists)
+	if len(lists) != 2 || lists[1].Name != "Relatives" {
+		t.Errorf("unexpected lists %+v", lists)
+	}
+
+	// Other users can't see or change the list.
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		recorder = serveTestJSON(server, method, fmt.Sprintf("/friends/lists/%d", work.ID), "U2",
+			"{\"name\": \"Mine\"}")
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("%s: expected %v; received %v", method, http.StatusNotFound, recorder.Code)
+		}
+	}
+
+	recorder = serveTestRequest(server, "DELETE", fmt.Sprintf("/friends/lists/%d", family.ID), "U1")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	if len(database.lists) != 1 {
+		t.Errorf("expected the list to be deleted, got %+v", database.lists)
+	}
+}
+
+func TestFriendListMemberHandlers(t *testing.T) {
+	database := newGraphTestDatabase()
+	server := MakeTestServer(database)
+	work := createTestFriendList(t, server, "U1", "Work")
+	url := fmt.Sprintf("/friends/lists/%d/members/", work.ID)
+
+	for _, member := range []string{"2", "3", "3"} {
+		recorder = serveTestRequest(server, "PUT", url+member, "U1")
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s: expected %v; received %v", member, http.StatusOK, recorder.Code)
+		}
+	}
+	recorder = serveTestRequest(server, "PUT", url+"5", "U1")
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected %v adding a non-friend; received %v", http.StatusBadRequest, recorder.Code)
+	}
+	recorder = serveTestRequest(server, "PUT", url+"2", "U2")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected %v on another user's list; received %v", http.StatusNotFound, recorder.Code)
+	}
+
+	recorder = serveTestRequest(server, "DELETE", url+"2", "U1")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	recorder = serveTestRequest(server, "DELETE", url+"2", "U1")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected %v removing a non-member; received %v", http.StatusNotFound, recorder.Code)
+	}
+	list, _ := database.getFriendList(ctx, work.ID)
+	if !sameIDs(list.Members, []uint{3}) {
+		t.Errorf("expected members [3], got %v", list.Members)
+	}
+}
+
+func TestUnfriendRemovesFromFriendLists(t *testing.T) {
+	for _, token := range []string{"U1", "U3"} {
+		database := newGraphTestDatabase()
+		server := MakeTestServer(database)
+		mine := createTestFriendList(t, server, "U1", "Close")
+		theirs := createTestFriendList(t, server, "U3", "Close")
+		serveTestRequest(server, "PUT", fmt.Sprintf("/friends/lists/%d/members/2", mine.ID), "U1")
+		serveTestRequest(server, "PUT", fmt.Sprintf("/friends/lists/%d/members/3", mine.ID), "U1")
+		serveTestRequest(server, "PUT", fmt.Sprintf("/friends/lists/%d/members/1", theirs.ID), "U3")
+
+		other := map[string]string{"U1": "3", "U3": "1"}[token]
+		recorder = serveTestRequest(server, "DELETE", "/friends/"+other, token)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: expected %v; received %v", token, http.StatusOK, recorder.Code)
+		}
+
+		mine, _ = database.getFriendList(ctx, mine.ID)
+		theirs, _ = database.getFriendList(ctx, theirs.ID)
+		if !sameIDs(mine.Members, []uint{2}) || len(theirs.Members) != 0 {
+			t.Errorf("%s: expected the friendship to leave both lists, got %v and %v",
+				token, mine.Members, theirs.Members)
+		}
+	}
+}
+
+func TestFriendNotesAreReturnedOnlyToTheirAuthor(t *testing.T) {
+	database := newGraphTestDatabase()
+	server := MakeTestServer(database)
+
+	recorder = serveTestJSON(server, "PUT", "/friends/2/note", "U1",
+		"{\"nickname\": \" Alex from work \", \"note\": \"Met at the offsite\"}")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	recorder = serveTestJSON(server, "PUT", "/friends/5/note", "U1", "{\"nickname\": \"Stranger\"}")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected %v for a non-friend; received %v", http.StatusNotFound, recorder.Code)
+	}
+	recorder = serveTestJSON(server, "PUT", "/friends/3/note", "U1",
+		fmt.Sprintf("{\"nickname\": %q}", strings.Repeat("a", maxNicknameLength+1)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected %v for a long nickname; received %v", http.StatusBadRequest, recorder.Code)
+	}
+
+	for token, expected := range map[string]string{"U1": "Alex from work", "U3": ""} {
+		var page FriendsPage
+		recorder = serveTestRequest(server, "GET", "/friends", token)
+		json.Unmarshal(recorder.Body.Bytes(), &page)
+		for _, friend := range page.Friends {
+			if friend.UserID == 2 && friend.Nickname != expected {
+				t.Errorf("%s: expected nickname %q, got %+v", token, expected, friend)
+			}
+		}
+	}
+
+	recorder = serveTestJSON(server, "PUT", "/friends/2/note", "U1", "{\"nickname\": \"\"}")
+	if recorder.Code != http.StatusOK || len(database.notes) != 0 {
+		t.Errorf("expected an empty note to be deleted, got %v and %+v", recorder.Code, database.notes)
+	}
+}
+
+func TestUnfriendKeepsFriendNotes(t *testing.T) {
+	database := newGraphTestDatabase()
+	server := MakeTestServer(database)
+	serveTestJSON(server, "PUT", "/friends/2/note", "U1", "{\"note\": \"mine\"}")
+	serveTestJSON(server, "PUT", "/friends/1/note", "U2", "{\"note\": \"theirs\"}")
+
+	recorder = serveTestRequest(server, "DELETE", "/friends/2", "U1")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	if len(database.notes) != 2 {
+		t.Errorf("expected both notes to be kept, got %+v", database.notes)
+	}
+
+	recorder = serveTestRequest(server, "DELETE", "/friends/2/note", "U1")
+	if recorder.Code != http.StatusOK || len(database.notes) != 1 {
+		t.Errorf("expected the note about a former friend to be deletable, got %v %+v",
+			recorder.Code, database.notes)
+	}
+}
+
+func getTestFriends(t *testing.T, server http.Handler, url, token string) FriendsPage {
+	var page FriendsPage
+	recorder = serveTestRequest(server, "GET", url, token)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("%s: expected %v; received %v", url, http.StatusOK, recorder.Code)
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &page)
+	return page
+}
+
+func friendIDs(friends []Friend) []uint {
+	ids := []uint{}
+	for _, friend := range friends {
+		ids = append(ids, friend.UserID)
+	}
+	return ids
+}
+
+func TestFavoritesLeadFriendsList(t *testing.T) {
+	database := newGraphTestDatabase()
+	server := MakeTestServer(database)
+
+	for _, friendID := range []string{"4", "2"} {
+		recorder = serveTestRequest(server, "PUT", "/friends/"+friendID+"/favorite", "U1")
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: expected %v; received %v", friendID, http.StatusOK, recorder.Code)
+		}
+	}
+
+	page := getTestFriends(t, server, "/friends", "U1")
+	if ids := friendIDs(page.Friends); !sameIDs(ids, []uint{4, 2, 3}) {
+		t.Errorf("expected favorites first, got %v", ids)
+	}
+	if !page.Friends[0].Favorite || page.Friends[2].Favorite {
+		t.Errorf("expected only favorites to be flagged, got %+v", page.Friends)
+	}
+
+	page = getTestFriends(t, server, "/friends?favorites=true", "U1")
+	if ids := friendIDs(page.Friends); !sameIDs(ids, []uint{4, 2}) || page.NextCursor != "" {
+		t.Errorf("expected only favorites, got %v", ids)
+	}
+
+	// Favorites aren't repeated on later pages.
+	seen := []uint{}
+	url := "/friends?limit=1"
+	for url != "" {
+		page = getTestFriends(t, server, url, "U1")
+		seen = append(seen, friendIDs(page.Friends)...)
+		url = ""
+		if page.NextCursor != "" {
+			url = "/friends?limit=1&cursor=" + page.NextCursor
+		}
+	}
+	if !sameIDs(seen, []uint{4, 2, 3}) {
+		t.Errorf("expected each friend once, got %v", seen)
+	}
+
+	recorder = serveTestRequest(server, "DELETE", "/friends/4/favorite", "U1")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	recorder = serveTestRequest(server, "DELETE", "/friends/4/favorite", "U1")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected %v; received %v", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestFavoritesRequireFriendshipAndAreCapped(t *testing.T) {
+	database := newGraphTestDatabase()
+	server := negroni.New()
+	mx := mux.NewRouter()
+	config := testConfig
+	config.MaxFavorites = 2
+	initRoutes(mx, formatter, database, config)
+	server.UseHandler(mx)
+
+	recorder = serveTestRequest(server, "PUT", "/friends/5/favorite", "U1")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected %v for a non-friend; received %v", http.StatusNotFound, recorder.Code)
+	}
+	for friendID, expected := range map[string]int{"2": http.StatusOK, "3": http.StatusOK} {
+		recorder = serveTestRequest(server, "PUT", "/friends/"+friendID+"/favorite", "U1")
+		if recorder.Code != expected {
+			t.Errorf("%s: expected %v; received %v", friendID, expected, recorder.Code)
+		}
+	}
+	recorder = serveTestRequest(server, "PUT", "/friends/4/favorite", "U1")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("expected %v over the cap; received %v", http.StatusConflict, recorder.Code)
+	}
+	recorder = serveTestRequest(server, "PUT", "/friends/2/favorite", "U1")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected re-favoriting to succeed; received %v", recorder.Code)
+	}
+
+	serveTestRequest(server, "DELETE", "/friends/2", "U1")
+	if favorites, _ := database.getFavorites(ctx, 1); !sameIDs(favorites, []uint{3}) {
+		t.Errorf("expected unfriending to drop the favorite, got %v", favorites)
+	}
+}
+
+func getTestFollows(t *testing.T, server http.Handler, url, token string) []uint {
+	var page FollowsPage
+	recorder = serveTestRequest(server, "GET", url, token)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("%s: expected %v; received %v", url, http.StatusOK, recorder.Code)
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &page)
+	ids := []uint{}
+	for _, follow := range page.Follows {
+		ids = append(ids, follow.UserID)
+	}
+	return ids
+}
+
+func TestFollowPublicAccount(t *testing.T) {
+	database := newGraphTestDatabase()
+	server := MakeTestServer(database)
+
+	recorder = serveTestRequest(server, "POST", "/follows/6", "U1")
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected %v; received %v", http.StatusCreated, recorder.Code)
+	}
+	recorder = serveTestRequest(server, "POST", "/follows/6", "U1")
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected %v following twice; received %v", http.StatusBadRequest, recorder.Code)
+	}
+	if ids := getTestFollows(t, server, "/following", "U1"); !sameIDs(ids, []uint{6}) {
+		t.Errorf("expected 1 to follow 6, got %v", ids)
+	}
+	if ids := getTestFollows(t, server, "/followers", "U6"); !sameIDs(ids, []uint{1}) {
+		t.Errorf("expected 6 to be followed by 1, got %v", ids)
+	}
+	if ids := getTestFollows(t, server, "/followers", "U1"); len(ids) != 0 {
+		t.Errorf("expected following to go one way, got %v", ids)
+	}
+
+	// Following someone isn't a friendship, and doesn't stand in the way
+	// of one.
+	if page := getTestFriends(t, server, "/friends", "U6"); !sameIDs(friendIDs(page.Friends), []uint{4}) {
+		t.Errorf("expected the follow not to be listed as a friend, got %+v", page.Friends)
+	}
+	recorder = serveTestJSON(server, "POST", "/friends/request", "U1", "{\"user_to_id\": 6}")
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("expected a friend request to be allowed; received %v", recorder.Code)
+	}
+
+	recorder = serveTestRequest(server, "DELETE", "/follows/6", "U1")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	recorder = serveTestRequest(server, "DELETE", "/follows/6", "U1")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected %v unfollowing twice; received %v", http.StatusNotFound, recorder.Code)
+	}
+	if ids := getTestFollows(t, server, "/followers", "U6"); len(ids) != 0 {
+		t.Errorf("expected no followers, got %v", ids)
+	}
+}
+
+func TestFollowPrivateAccountNeedsApproval(t *testing.T) {
+	database := newGraphTestDatabase()
+	database.upsertSettings(ctx, Settings{UserID: 6, AllowRequestsFrom: AllowEveryone, Private: true})
+	server := MakeTestServer(database)
+
+	for _, token := range []string{"U1", "U2"} {
+		recorder = serveTestRequest(server, "POST", "/follows/6", token)
+		if recorder.Code != http.StatusCreated {
+			t.Fatalf("%s: expected %v; received %v", token, http.StatusCreated, recorder.Code)
+		}
+	}
+	if ids := getTestFollows(t, server, "/followers", "U6"); len(ids) != 0 {
+		t.Errorf("expected follows to wait for approval, got %v", ids)
+	}
+	cooldown := strconv.Itoa(int(testConfig.RejectionCooldown.Seconds()))
+	recorder = serveTestRequest(server, "POST", "/follows/6", "U2")
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != cooldown {
+		t.Errorf("expected a pending follower to wait %vs; received %v after %q", cooldown,
+			recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	pendingBody := recorder.Body.String()
+
+	var incoming RequestsPage
+	recorder = serveTestRequest(server, "GET", "/friends/requests/incoming", "U6")
+	json.Unmarshal(recorder.Body.Bytes(), &incoming)
+	if len(incoming.Requests) != 0 {
+		t.Errorf("expected follow requests to stay out of the friend requests, got %+v", incoming.Requests)
+	}
+	recorder = serveTestRequest(server, "GET", "/follows/requests", "U6")
+	json.Unmarshal(recorder.Body.Bytes(), &incoming)
+	if len(incoming.Requests) != 2 || incoming.Requests[0].Kind != KindFollow {
+		t.Fatalf("expected two follow requests, got %+v", incoming.Requests)
+	}
+	requestIDs := map[uint]uint{}
+	for _, request := range incoming.Requests {
+		requestIDs[request.UserFromID] = request.ID
+	}
+
+	recorder = serveTestRequest(server, "PUT", fmt.Sprintf("/friends/%d/accept", requestIDs[1]), "U6")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	recorder = serveTestRequest(server, "PUT", fmt.Sprintf("/friends/%d/reject", requestIDs[2]), "U6")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	if ids := getTestFollows(t, server, "/followers", "U6"); !sameIDs(ids, []uint{1}) {
+		t.Errorf("expected only the accepted follower, got %v", ids)
+	}
+
+	// The rejected follower gets the same answer as while they were pending.
+	recorder = serveTestRequest(server, "POST", "/follows/6", "U2")
+	if recorder.Code != http.StatusTooManyRequests || recorder.Body.String() != pendingBody {
+		t.Errorf("expected a rejected follower to wait; received %v %q", recorder.Code, recorder.Body.String())
+	}
+	if retry, _ := strconv.Atoi(recorder.Header().Get("Retry-After")); retry < 1 || retry > int(testConfig.RejectionCooldown.Seconds()) {
+		t.Errorf("expected to wait out the cooldown, Retry-After %q", recorder.Header().Get("Retry-After"))
+	}
+}
+
+func TestBlockEndsFollowsBothWays(t *testing.T) {
+	database := newGraphTestDatabase()
+	server := MakeTestServer(database)
+	serveTestRequest(server, "POST", "/follows/6", "U1")
+	serveTestRequest(server, "POST", "/follows/1", "U6")
+
+	recorder = serveTestJSON(server, "POST", "/blocks", "U6", "{\"blocked_user_id\": 1}")
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected %v; received %v", http.StatusCreated, recorder.Code)
+	}
+	if ids := getTestFollows(t, server, "/following", "U1"); len(ids) != 0 {
+		t.Errorf("expected the block to end 1's follow, got %v", ids)
+	}
+	if ids := getTestFollows(t, server, "/following", "U6"); len(ids) != 0 {
+		t.Errorf("expected the block to end 6's follow, got %v", ids)
+	}
+
+	// The blocked user can't tell their follow didn't go through.
+	recorder = serveTestRequest(server, "POST", "/follows/6", "U1")
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("expected %v; received %v", http.StatusCreated, recorder.Code)
+	}
+	if ids := getTestFollows(t, server, "/followers", "U6"); len(ids) != 0 {
+		t.Errorf("expected no followers, got %v", ids)
+	}
+}
@@ -0,0 +1,525 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errDuplicate = errors.New("Duplicate key")
+
+type memoryValue struct {
+	value     string
+	expiresAt time.Time
+}
+
+type memoryFavorite struct {
+	friendID  uint
+	createdAt time.Time
+}
+
+// memoryDatabase keeps everything in memory, for local development, demos
+// and tests that don't need Postgres or Redis. It behaves like dataHandler,
+// down to the errors it returns when nothing is found, and is safe to use
+// from many goroutines at once. Its operations never wait on anything, so
+// they ignore their context.
+type memoryDatabase struct {
+	mu        sync.RWMutex
+	requests  []FriendRequest
+	blocks    []Block
+	dismissed map[uint]map[uint]bool
+	settings  map[uint]Settings
+	lists     []FriendList
+	notes     map[[2]uint]FriendNote
+	favorites map[uint][]memoryFavorite
+	values    map[string]memoryValue
+	sweepAt   int
+	lastID    map[string]uint
+}
+
+func newMemoryDatabase() *memoryDatabase {
+	return &memoryDatabase{
+		dismissed: map[uint]map[uint]bool{},
+		settings:  map[uint]Settings{},
+		notes:     map[[2]uint]FriendNote{},
+		favorites: map[uint][]memoryFavorite{},
+		values:    map[string]memoryValue{},
+		lastID:    map[string]uint{},
+	}
+}
+
+// nextID hands out ids per table the way a SERIAL column would.
+func (m *memoryDatabase) nextID(table string) uint {
+	m.lastID[table]++
+	return m.lastID[table]
+}
+
+// latestRequest returns the newest friend request from userFrom to userTo,
+// or the newest follow request when follow is set.
+func (m *memoryDatabase) latestRequest(userFrom, userTo uint, follow bool) (FriendRequest, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var latest FriendRequest
+	found := false
+	for _, request := range m.requests {
+		if request.UserFromID != userFrom || request.UserToID != userTo || request.isFollow() != follow {
+			continue
+		}
+		if !found || !request.CreatedAt.Before(latest.CreatedAt) {
+			latest, found = request, true
+		}
+	}
+	if !found {
+		return FriendRequest{}, sql.ErrNoRows
+	}
+	return latest, nil
+}
+
+// filterRequests returns the requests keep picks.
+func (m *memoryDatabase) filterRequests(keep func(request FriendRequest) bool) []FriendRequest {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var requests []FriendRequest
+	for _, request := range m.requests {
+		if keep(request) {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+func (m *memoryDatabase) getFriendRequestByUserFromAndTo(ctx context.Context, userFrom, userTo uint) (FriendRequest, error) {
+	return m.latestRequest(userFrom, userTo, false)
+}
+
+func (m *memoryDatabase) getFollowRequest(ctx context.Context, follower, followee uint) (FriendRequest, error) {
+	return m.latestRequest(follower, followee, true)
+}
+
+func (m *memoryDatabase) getFriendRequestByID(ctx context.Context, requestID uint) (FriendRequest, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, request := range m.requests {
+		if request.ID == requestID {
+			return request, nil
+		}
+	}
+	return FriendRequest{}, sql.ErrNoRows
+}
+
+func (m *memoryDatabase) insertFriendRequest(ctx context.Context, request FriendRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	request.ID = m.nextID("friend_requests")
+	if !request.isFollow() {
+		request.Kind = KindFriend
+	}
+	m.requests = append(m.requests, request)
+	return nil
+}
+
+func (m *memoryDatabase) updateFriendRequest(ctx context.Context, request FriendRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, stored := range m.requests {
+		if stored.ID == request.ID {
+			stored.Status = request.Status
+			stored.AcceptedAt = request.AcceptedAt
+			stored.RejectedAt = request.RejectedAt
+			stored.CancelledAt = request.CancelledAt
+			stored.EndedAt = request.EndedAt
+			stored.EndedBy = request.EndedBy
+			m.requests[i] = stored
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryDatabase) getFriendsByUserID(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	requests := m.filterRequests(func(request FriendRequest) bool {
+		return (request.UserFromID == userID || request.UserToID == userID) &&
+			request.Status == StatusAccepted && !request.isFollow()
+	})
+	return paginateRequests(userID, requests, page, friendsSince), nil
+}
+
+func (m *memoryDatabase) getFriendsByUserIDs(ctx context.Context, userIDs []uint, limit int) ([]FriendRequest, error) {
+	wanted := map[uint]bool{}
+	for _, userID := range userIDs {
+		wanted[userID] = true
+	}
+	requests := m.filterRequests(func(request FriendRequest) bool {
+		return (wanted[request.UserFromID] || wanted[request.UserToID]) &&
+			request.Status == StatusAccepted && !request.isFollow()
+	})
+	sort.Slice(requests, func(i, j int) bool {
+		if !requests[i].AcceptedAt.Equal(requests[j].AcceptedAt) {
+			return requests[i].AcceptedAt.Before(requests[j].AcceptedAt)
+		}
+		return requests[i].ID < requests[j].ID
+	})
+	if limit > 0 && len(requests) > limit {
+		requests = requests[:limit]
+	}
+	return requests, nil
+}
+
+func (m *memoryDatabase) getRequestsBetween(ctx context.Context, userID uint, otherIDs []uint) ([]FriendRequest, error) {
+	wanted := map[uint]bool{}
+	for _, otherID := range otherIDs {
+		wanted[otherID] = true
+	}
+	return m.filterRequests(func(request FriendRequest) bool {
+		switch request.Status {
+		case StatusPending, StatusAccepted, StatusRejected:
+		default:
+			return false
+		}
+		return !request.isFollow() &&
+			((request.UserFromID == userID && wanted[request.UserToID]) ||
+				(request.UserToID == userID && wanted[request.UserFromID]))
+	}), nil
+}
+
+func (m *memoryDatabase) getPendingRequestsToUser(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	requests := m.filterRequests(func(request FriendRequest) bool {
+		return request.UserToID == userID && request.Status == StatusPending && !request.isFollow()
+	})
+	return paginateRequests(userID, requests, page, requestedSince), nil
+}
+
+func (m *memoryDatabase) getPendingRequestsFromUser(ctx context.Context, userID uint, rejectedSince time.Time,
+	page Page) ([]FriendRequest, error) {
+	requests := m.filterRequests(func(request FriendRequest) bool {
+		return request.UserFromID == userID && !request.isFollow() && (request.Status == StatusPending ||
+			request.Status == StatusRejected && request.RejectedAt.After(rejectedSince))
+	})
+	return paginateRequests(userID, requests, page, requestedSince), nil
+}
+
+func (m *memoryDatabase) getFollowers(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	requests := m.filterRequests(func(request FriendRequest) bool {
+		return request.UserToID == userID && request.Status == StatusAccepted && request.isFollow()
+	})
+	return paginateRequests(userID, requests, page, friendsSince), nil
+}
+
+func (m *memoryDatabase) getFollowing(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	requests := m.filterRequests(func(request FriendRequest) bool {
+		return request.UserFromID == userID && request.Status == StatusAccepted && request.isFollow()
+	})
+	return paginateRequests(userID, requests, page, friendsSince), nil
+}
+
+func (m *memoryDatabase) getPendingFollowRequests(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+	requests := m.filterRequests(func(request FriendRequest) bool {
+		return request.UserToID == userID && request.Status == StatusPending && request.isFollow()
+	})
+	return paginateRequests(userID, requests, page, requestedSince), nil
+}
+
+func (m *memoryDatabase) expireFriendRequests(ctx context.Context, createdBefore time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var expired int64
+	for i, request := range m.requests {
+		if request.Status == StatusPending && request.CreatedAt.Before(createdBefore) {
+			m.requests[i].Status = StatusExpired
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+func (m *memoryDatabase) insertBlock(ctx context.Context, block Block) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.blocks {
+		if existing.UserID == block.UserID && existing.BlockedUserID == block.BlockedUserID {
+			return errDuplicate
+		}
+	}
+	block.ID = m.nextID("blocks")
+	m.blocks = append(m.blocks, block)
+	return nil
+}
+
+func (m *memoryDatabase) deleteBlock(ctx context.Context, userID, blockedUserID uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, block := range m.blocks {
+		if block.UserID == userID && block.BlockedUserID == blockedUserID {
+			m.blocks = append(m.blocks[:i:i], m.blocks[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryDatabase) getBlockBetween(ctx context.Context, userA, userB uint) (Block, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, block := range m.blocks {
+		if (block.UserID == userA && block.BlockedUserID == userB) ||
+			(block.UserID == userB && block.BlockedUserID == userA) {
+			return block, nil
+		}
+	}
+	return Block{}, sql.ErrNoRows
+}
+
+func (m *memoryDatabase) getBlocksInvolvingUser(ctx context.Context, userID uint) ([]Block, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var blocks []Block
+	for _, block := range m.blocks {
+		if block.UserID == userID || block.BlockedUserID == userID {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks, nil
+}
+
+func (m *memoryDatabase) insertDismissedSuggestion(ctx context.Context, userID, dismissedUserID uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dismissed[userID] == nil {
+		m.dismissed[userID] = map[uint]bool{}
+	}
+	m.dismissed[userID][dismissedUserID] = true
+	return nil
+}
+
+func (m *memoryDatabase) getDismissedSuggestions(ctx context.Context, userID uint) ([]uint, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var dismissed []uint
+	for dismissedUserID := range m.dismissed[userID] {
+		dismissed = append(dismissed, dismissedUserID)
+	}
+	return dismissed, nil
+}
+
+func (m *memoryDatabase) getSettings(ctx context.Context, userID uint) (Settings, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	settings, ok := m.settings[userID]
+	if !ok {
+		return Settings{}, sql.ErrNoRows
+	}
+	return settings, nil
+}
+
+func (m *memoryDatabase) upsertSettings(ctx context.Context, settings Settings) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.settings[settings.UserID] = settings
+	return nil
+}
+
+func (m *memoryDatabase) insertFriendList(ctx context.Context, list FriendList) (uint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.lists {
+		if existing.UserID == list.UserID && existing.Name == list.Name {
+			return 0, errDuplicate
+		}
+	}
+	list.ID = m.nextID("friend_lists")
+	list.Members = []uint{}
+	m.lists = append(m.lists, list)
+	return list.ID, nil
+}
+
+func (m *memoryDatabase) updateFriendList(ctx context.Context, list FriendList) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, existing := range m.lists {
+		if existing.ID == list.ID {
+			m.lists[i].Name = list.Name
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryDatabase) deleteFriendList(ctx context.Context, listID uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, list := range m.lists {
+		if list.ID == listID {
+			m.lists = append(m.lists[:i:i], m.lists[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// copyList returns list with its own sorted copy of the members.
+func copyList(list FriendList) FriendList {
+	list.Members = append([]uint{}, list.Members...)
+	sort.Sort(userIDs(list.Members))
+	return list
+}
+
+func (m *memoryDatabase) getFriendList(ctx context.Context, listID uint) (FriendList, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, list := range m.lists {
+		if list.ID == listID {
+			return copyList(list), nil
+		}
+	}
+	return FriendList{}, sql.ErrNoRows
+}
+
+func (m *memoryDatabase) getFriendListsByUserID(ctx context.Context, userID uint) ([]FriendList, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	lists := []FriendList{}
+	for _, list := range m.lists {
+		if list.UserID == userID {
+			lists = append(lists, copyList(list))
+		}
+	}
+	return lists, nil
+}
+
+func (m *memoryDatabase) insertFriendListMember(ctx context.Context, listID, memberID uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, list := range m.lists {
+		if list.ID == listID {
+			if !list.hasMember(memberID) {
+				m.lists[i].Members = append(list.Members, memberID)
+			}
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryDatabase) deleteFriendListMember(ctx context.Context, listID, memberID uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, list := range m.lists {
+		if list.ID == listID {
+			m.lists[i].removeMember(memberID)
+		}
+	}
+	return nil
+}
+
+func (m *memoryDatabase) removeFromFriendLists(ctx context.Context, userID, memberID uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, list := range m.lists {
+		if list.UserID == userID {
+			m.lists[i].removeMember(memberID)
+		}
+	}
+	return nil
+}
+
+func (m *memoryDatabase) upsertFriendNote(ctx context.Context, note FriendNote) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notes[[2]uint{note.UserID, note.FriendID}] = note
+	return nil
+}
+
+func (m *memoryDatabase) deleteFriendNote(ctx context.Context, userID, friendID uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.notes, [2]uint{userID, friendID})
+	return nil
+}
+
+func (m *memoryDatabase) getFriendNotes(ctx context.Context, userID uint, friendIDs []uint) ([]FriendNote, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var notes []FriendNote
+	for _, friendID := range friendIDs {
+		if note, ok := m.notes[[2]uint{userID, friendID}]; ok {
+			notes = append(notes, note)
+		}
+	}
+	return notes, nil
+}
+
+func (m *memoryDatabase) insertFavorite(ctx context.Context, userID, friendID uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, favorite := range m.favorites[userID] {
+		if favorite.friendID == friendID {
+			return nil
+		}
+	}
+	m.favorites[userID] = append(m.favorites[userID],
+		memoryFavorite{friendID: friendID, createdAt: time.Now()})
+	return nil
+}
+
+func (m *memoryDatabase) deleteFavorite(ctx context.Context, userID, friendID uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var kept []memoryFavorite
+	for _, favorite := range m.favorites[userID] {
+		if favorite.friendID != friendID {
+			kept = append(kept, favorite)
+		}
+	}
+	m.favorites[userID] = kept
+	return nil
+}
+
+// getFavorites returns the friends userID marked as favorites, in the order
+// they were marked.
+func (m *memoryDatabase) getFavorites(ctx context.Context, userID uint) ([]uint, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var favorites []uint
+	for _, favorite := range m.favorites[userID] {
+		favorites = append(favorites, favorite.friendID)
+	}
+	return favorites, nil
+}
+
+// redisGetValue and redisSetValue stand in for Redis. Like Redis, a zero
+// expiry keeps the value forever and a missing key is an error.
+func (m *memoryDatabase) redisGetValue(ctx context.Context, key string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stored, ok := m.values[key]
+	if !ok || (!stored.expiresAt.IsZero() && time.Now().After(stored.expiresAt)) {
+		return "", errNoValue
+	}
+	return stored.value, nil
+}
+
+func (m *memoryDatabase) redisSetValue(ctx context.Context, key, value string, seconds time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	stored := memoryValue{value: value}
+	if seconds > 0 {
+		stored.expiresAt = now.Add(seconds)
+	}
+	m.values[key] = stored
+
+	// Drop expired values whenever the store has doubled in size since the
+	// last sweep, so it doesn't grow without bound.
+	if len(m.values) >= m.sweepAt {
+		for key, stored := range m.values {
+			if !stored.expiresAt.IsZero() && now.After(stored.expiresAt) {
+				delete(m.values, key)
+			}
+		}
+		m.sweepAt = 2*len(m.values) + 64
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryDatabaseUpdatesRequestByID(t *testing.T) {
+	database := newMemoryDatabase()
+	database.insertFriendRequest(ctx, AddFriend(1, 2))
+	first, _ := database.getFriendRequestByUserFromAndTo(ctx, 1, 2)
+	first.cancel()
+	database.updateFriendRequest(ctx, first)
+	database.insertFriendRequest(ctx, AddFriend(1, 2))
+
+	latest, err := database.getFriendRequestByUserFromAndTo(ctx, 1, 2)
+	if err != nil || latest.ID == first.ID || !latest.isPending() {
+		t.Fatalf("Expected the newer pending request, got %+v (%v)", latest, err)
+	}
+	latest.accept()
+	database.updateFriendRequest(ctx, latest)
+
+	stored, _ := database.getFriendRequestByID(ctx, first.ID)
+	if stored.Status != StatusCancelled {
+		t.Errorf("Expected the first request to stay cancelled, got %s", stored.Status)
+	}
+	if err = database.updateFriendRequest(ctx, FriendRequest{ID: 99}); err == nil {
+		t.Errorf("Expected updating a missing request to fail")
+	}
+}
+
+func TestMemoryDatabaseIsSafeForConcurrentUse(t *testing.T) {
+	database := newMemoryDatabase()
+	var wg sync.WaitGroup
+	for i := uint(1); i <= 50; i++ {
+		wg.Add(1)
+		go func(userID uint) {
+			defer wg.Done()
+			database.insertFriendRequest(ctx, AddFriend(userID, 1000))
+			database.getPendingRequestsToUser(ctx, 1000, defaultPage())
+			database.redisSetValue(ctx, "key", "value", time.Minute)
+			database.redisGetValue(ctx, "key")
+		}(i)
+	}
+	wg.Wait()
+
+	requests, _ := database.getPendingRequestsToUser(ctx, 1000, Page{Limit: maxPageLimit, Sort: sortSinceAsc})
+	seen := map[uint]bool{}
+	for _, request := range requests {
+		seen[request.ID] = true
+	}
+	if len(requests) != 50 || len(seen) != 50 {
+		t.Errorf("Expected 50 requests with distinct ids, got %d with %d ids", len(requests), len(seen))
+	}
+}
+
+func TestMemoryDatabaseValuesExpire(t *testing.T) {
+	database := newMemoryDatabase()
+	database.redisSetValue(ctx, "forever", "1", 0)
+	database.redisSetValue(ctx, "gone", "1", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	if value, err := database.redisGetValue(ctx, "forever"); err != nil || value != "1" {
+		t.Errorf("Expected the value to be kept, got %q (%v)", value, err)
+	}
+	if _, err := database.redisGetValue(ctx, "gone"); err == nil {
+		t.Errorf("Expected the value to have expired")
+	}
+	if _, err := database.redisGetValue(ctx, "missing"); err == nil {
+		t.Errorf("Expected a missing key to be an error")
+	}
+}
+
+func TestServerWithMemoryBackend(t *testing.T) {
+	config := DefaultConfig()
+	config.Backend = BackendMemory
+	config.MemoryTokens = map[string]uint{"ALICE": 1, "BOB": 2}
+	server := NewServer(config)
+	defer server.Close()
+
+	recorder := serveTestRequest(server, "GET", "/friends", "MALLORY")
+	if recorder.Code == http.StatusOK {
+		t.Errorf("Expected an unknown token to be turned away")
+	}
+
+	recorder = serveTestJSON(server, "POST", "/friends/request", "ALICE", "{\"user_to_id\": 2}")
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected %v; received %v", http.StatusCreated, recorder.Code)
+	}
+	var incoming RequestsPage
+	recorder = serveTestRequest(server, "GET", "/friends/requests/incoming", "BOB")
+	json.Unmarshal(recorder.Body.Bytes(), &incoming)
+	if len(incoming.Requests) != 1 {
+		t.Fatalf("Expected one incoming request, got %+v", incoming.Requests)
+	}
+	recorder = serveTestRequest(server, "PUT", "/friends/1/accept", "BOB")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+
+	var page FriendsPage
+	recorder = serveTestRequest(server, "GET", "/friends", "ALICE")
+	json.Unmarshal(recorder.Body.Bytes(), &page)
+	if len(page.Friends) != 1 || page.Friends[0].UserID != 2 {
+		t.Errorf("Expected Bob to be Alice's friend, got %+v", page.Friends)
+	}
+}
+
+func TestParseTokens(t *testing.T) {
+	tokens, err := parseTokens("alice:1, bob:2")
+	if err != nil || tokens["alice"] != 1 || tokens["bob"] != 2 {
+		t.Errorf("Unexpected tokens %v (%v)", tokens, err)
+	}
+	for _, raw := range []string{"alice", "alice:", ":1", "alice:0", "alice:x"} {
+		if _, err := parseTokens(raw); err == nil {
+			t.Errorf("Expected %q to be invalid", raw)
+		}
+	}
+}
@@ -1,20 +1,36 @@
 package service
 
-import "net/http"
+import (
+	"context"
+	"net/http"
 
-// The middleware handler
-func AuthMiddleware(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
-	key := req.Header.Get("Authorization")
-	w.Header().Set("Content-Type", "application/json")
-	if key == "" {
-		http.Error(w, "Failed to find token", http.StatusInternalServerError)
-		return
-	}
+	"github.com/urfave/negroni"
+)
+
+// AuthMiddleware turns away requests without a token the database knows or
+// one of serviceTokens.
+func AuthMiddleware(database Database, serviceTokens []string) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		key := req.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		if key == "" {
+			http.Error(w, "Failed to find token", http.StatusInternalServerError)
+			return
+		}
+		if isServiceToken(key, serviceTokens) {
+			next(w, req)
+			return
+		}
 
-	_, err := REDIS.Get(key).Result()
-	if err != nil {
-		http.Error(w, "Not a valid token", http.StatusInternalServerError)
-		return
+		_, err := database.redisGetValue(req.Context(), key)
+		if err == context.DeadlineExceeded {
+			http.Error(w, "Timed out looking up token", http.StatusGatewayTimeout)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Not a valid token", http.StatusInternalServerError)
+			return
+		}
+		next(w, req)
 	}
-	next(w, req)
 }
@@ -0,0 +1,298 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+//Migration is one versioned step of the database schema
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+//MigrationState is a migration along with when it was applied, if it was
+type MigrationState struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// postgresMigrations builds up the schema in order. Once released a migration
+// must not change: fix mistakes with a new one. Every dialect has the same
+// versions, so a change to the schema needs a migration in each.
+var postgresMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_friend_requests",
+		Up: `CREATE TABLE friend_requests (
+			id           SERIAL PRIMARY KEY,
+			user_from_id INTEGER NOT NULL,
+			user_to_id   INTEGER NOT NULL,
+			status       VARCHAR(16) NOT NULL DEFAULT 'pending'
+			             CHECK (status IN ('pending', 'accepted', 'rejected', 'cancelled',
+			                               'expired', 'unfriended')),
+			created_at   TIMESTAMP NOT NULL DEFAULT now(),
+			accepted_at  TIMESTAMP,
+			rejected_at  TIMESTAMP,
+			cancelled_at TIMESTAMP,
+			ended_at     TIMESTAMP,
+			ended_by     INTEGER
+		);
+		CREATE INDEX friend_requests_user_from_idx
+			ON friend_requests (user_from_id, status, created_at, id);
+		CREATE INDEX friend_requests_user_to_idx
+			ON friend_requests (user_to_id, status, created_at, id);`,
+		Down: `DROP TABLE friend_requests;`,
+	},
+	{
+		Version: 2,
+		Name:    "create_blocks",
+		Up: `CREATE TABLE blocks (
+			id              SERIAL PRIMARY KEY,
+			user_id         INTEGER NOT NULL,
+			blocked_user_id INTEGER NOT NULL,
+			created_at      TIMESTAMP NOT NULL DEFAULT now(),
+			UNIQUE (user_id, blocked_user_id)
+		);`,
+		Down: `DROP TABLE blocks;`,
+	},
+	{
+		Version: 3,
+		Name:    "create_user_settings",
+		Up: `CREATE TABLE user_settings (
+			user_id             INTEGER PRIMARY KEY,
+			allow_requests_from VARCHAR(32) NOT NULL DEFAULT 'everyone'
+			                    CHECK (allow_requests_from IN ('everyone', 'friends_of_friends', 'nobody'))
+		);`,
+		Down: `DROP TABLE user_settings;`,
+	},
+	{
+		Version: 4,
+		Name:    "create_dismissed_suggestions",
+		Up: `CREATE TABLE dismissed_suggestions (
+			user_id           INTEGER NOT NULL,
+			dismissed_user_id INTEGER NOT NULL,
+			created_at        TIMESTAMP NOT NULL DEFAULT now(),
+			PRIMARY KEY (user_id, dismissed_user_id)
+		);`,
+		Down: `DROP TABLE dismissed_suggestions;`,
+	},
+	{
+		Version: 5,
+		Name:    "create_friend_lists",
+		Up: `CREATE TABLE friend_lists (
+			id         SERIAL PRIMARY KEY,
+			user_id    INTEGER NOT NULL,
+			name       VARCHAR(64) NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT now(),
+			UNIQUE (user_id, name)
+		);
+		CREATE TABLE friend_list_members (
+			list_id   INTEGER NOT NULL REFERENCES friend_lists (id) ON DELETE CASCADE,
+			member_id INTEGER NOT NULL,
+			PRIMARY KEY (list_id, member_id)
+		);`,
+		Down: `DROP TABLE friend_list_members;
+		DROP TABLE friend_lists;`,
+	},
+	{
+		Version: 6,
+		Name:    "create_friend_notes",
+		Up: `CREATE TABLE friend_notes (
+			user_id    INTEGER NOT NULL,
+			friend_id  INTEGER NOT NULL,
+			nickname   VARCHAR(64) NOT NULL DEFAULT '',
+			note       TEXT NOT NULL DEFAULT '',
+			updated_at TIMESTAMP NOT NULL DEFAULT now(),
+			PRIMARY KEY (user_id, friend_id)
+		);`,
+		Down: `DROP TABLE friend_notes;`,
+	},
+	{
+		Version: 7,
+		Name:    "create_favorites",
+		Up: `CREATE TABLE favorites (
+			user_id    INTEGER NOT NULL,
+			friend_id  INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT now(),
+			PRIMARY KEY (user_id, friend_id)
+		);`,
+		Down: `DROP TABLE favorites;`,
+	},
+	{
+		Version: 8,
+		Name:    "add_follows",
+		Up: `ALTER TABLE friend_requests ADD COLUMN kind VARCHAR(16) NOT NULL DEFAULT 'friend'
+			CHECK (kind IN ('friend', 'follow'));
+		ALTER TABLE user_settings ADD COLUMN private BOOLEAN NOT NULL DEFAULT false;`,
+		Down: `ALTER TABLE user_settings DROP COLUMN private;
+		ALTER TABLE friend_requests DROP COLUMN kind;`,
+	},
+}
+
+//LatestSchemaVersion is the schema version this build expects of the given
+//SQL backend
+func LatestSchemaVersion(backend string) int {
+	migrations := dialectFor(backend).migrations
+	return migrations[len(migrations)-1].Version
+}
+
+const createSchemaMigrations = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	name       VARCHAR(128) NOT NULL,
+	applied_at TIMESTAMP NOT NULL
+);`
+
+// appliedMigrations returns when each applied migration was applied.
+func appliedMigrations(db *sql.DB) (map[int]time.Time, error) {
+	if _, err := db.Exec(createSchemaMigrations); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT VERSION, APPLIED_AT FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+//SchemaVersion returns the version of the newest migration applied to db
+func SchemaVersion(db *sql.DB) (int, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for applied := range applied {
+		if applied > version {
+			version = applied
+		}
+	}
+	return version, nil
+}
+
+//CheckSchemaVersion refuses to run against a database that is missing
+//migrations this build needs
+func CheckSchemaVersion(db *sql.DB, backend string) error {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if latest := LatestSchemaVersion(backend); version < latest {
+		return fmt.Errorf("Database schema is at version %d but %d is needed, run `migrate up`",
+			version, latest)
+	}
+	return nil
+}
+
+//MigrationStatus lists every migration of the given SQL backend and whether
+//it has been applied
+func MigrationStatus(db *sql.DB, backend string) ([]MigrationState, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	migrations := dialectFor(backend).migrations
+	states := make([]MigrationState, len(migrations))
+	for i, migration := range migrations {
+		appliedAt, ok := applied[migration.Version]
+		states[i] = MigrationState{Migration: migration, Applied: ok, AppliedAt: appliedAt}
+	}
+	return states, nil
+}
+
+//MigrateUp applies every migration that hasn't been applied yet, in order,
+//and returns the ones it applied
+func MigrateUp(db *sql.DB, backend string) ([]Migration, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	dialect := dialectFor(backend)
+	var done []Migration
+	for _, migration := range pendingMigrations(dialect.migrations, applied) {
+		err = runMigration(db, migration.Up, dialect.rebind(`INSERT INTO schema_migrations
+			(VERSION, NAME, APPLIED_AT) VALUES($1, $2, $3)`),
+			migration.Version, migration.Name, time.Now().UTC())
+		if err != nil {
+			return done, fmt.Errorf("Migration %d %s failed: %v", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+//MigrateDown reverts the newest steps applied migrations and returns the
+//ones it reverted
+func MigrateDown(db *sql.DB, backend string, steps int) ([]Migration, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	dialect := dialectFor(backend)
+	var done []Migration
+	for _, migration := range revertibleMigrations(dialect.migrations, applied, steps) {
+		err = runMigration(db, migration.Down, dialect.rebind(`DELETE FROM schema_migrations
+			WHERE version=$1`), migration.Version)
+		if err != nil {
+			return done, fmt.Errorf("Reverting migration %d %s failed: %v", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// runMigration runs a migration's statements and records it in one
+// transaction, so a failed migration leaves nothing behind.
+func runMigration(db *sql.DB, statements, record string, args ...interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(statements); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec(record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// pendingMigrations returns the migrations that haven't been applied, oldest
+// first.
+func pendingMigrations(migrations []Migration, applied map[int]time.Time) []Migration {
+	var pending []Migration
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+	return pending
+}
+
+// revertibleMigrations returns the newest steps applied migrations, newest
+// first.
+func revertibleMigrations(migrations []Migration, applied map[int]time.Time, steps int) []Migration {
+	var revert []Migration
+	for i := len(migrations) - 1; i >= 0 && len(revert) < steps; i-- {
+		if _, ok := applied[migrations[i].Version]; ok {
+			revert = append(revert, migrations[i])
+		}
+	}
+	return revert
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	for i, migration := range postgresMigrations {
+		if migration.Version != i+1 {
+			t.Errorf("Expected migration %d to have version %d, got %d", i, i+1, migration.Version)
+		}
+		if migration.Name == "" || migration.Up == "" || migration.Down == "" {
+			t.Errorf("Migration %d is missing its name, up or down", migration.Version)
+		}
+	}
+	if LatestSchemaVersion(BackendPostgres) != len(postgresMigrations) {
+		t.Errorf("Expected latest version %d, got %d", len(postgresMigrations),
+			LatestSchemaVersion(BackendPostgres))
+	}
+}
+
+func TestSQLiteMigrationsMirrorPostgres(t *testing.T) {
+	if len(sqliteMigrations) != len(postgresMigrations) {
+		t.Fatalf("Expected %d SQLite migrations, got %d", len(postgresMigrations), len(sqliteMigrations))
+	}
+	for i, migration := range sqliteMigrations {
+		if migration.Version != postgresMigrations[i].Version || migration.Name != postgresMigrations[i].Name {
+			t.Errorf("Expected SQLite migration %d to be %d %s, got %d %s", i,
+				postgresMigrations[i].Version, postgresMigrations[i].Name, migration.Version, migration.Name)
+		}
+	}
+}
+
+func migrationVersions(migrations []Migration) []int {
+	versions := []int{}
+	for _, migration := range migrations {
+		versions = append(versions, migration.Version)
+	}
+	return versions
+}
+
+func sameVersions(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPendingAndRevertibleMigrations(t *testing.T) {
+	steps := []Migration{{Version: 1}, {Version: 2}, {Version: 3}, {Version: 4}}
+	now := time.Now()
+	applied := map[int]time.Time{1: now, 2: now}
+
+	if pending := migrationVersions(pendingMigrations(steps, applied)); !sameVersions(pending, []int{3, 4}) {
+		t.Errorf("Expected 3 and 4 to be pending, got %v", pending)
+	}
+	if revert := migrationVersions(revertibleMigrations(steps, applied, 1)); !sameVersions(revert, []int{2}) {
+		t.Errorf("Expected to revert 2, got %v", revert)
+	}
+	if revert := migrationVersions(revertibleMigrations(steps, applied, 5)); !sameVersions(revert, []int{2, 1}) {
+		t.Errorf("Expected to revert 2 then 1, got %v", revert)
+	}
+	if revert := revertibleMigrations(steps, map[int]time.Time{}, 1); len(revert) != 0 {
+		t.Errorf("Expected nothing to revert, got %v", revert)
+	}
+}
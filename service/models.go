@@ -1,37 +1,355 @@
 package service
 
 import (
+	"fmt"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
+// Friend request statuses. A request starts out pending and moves to exactly
+// one of the answered statuses. An accepted request is a friendship, which
+// either side can later end.
+const (
+	StatusPending    = "pending"
+	StatusAccepted   = "accepted"
+	StatusRejected   = "rejected"
+	StatusCancelled  = "cancelled"
+	StatusExpired    = "expired"
+	StatusUnfriended = "unfriended"
+)
+
+// Kinds of request. A friend request asks for a mutual friendship, while a
+// follow request asks to follow a private account and only goes one way.
+const (
+	KindFriend = "friend"
+	KindFollow = "follow"
+)
+
+// requestTransitions lists the statuses each status may move to.
+var requestTransitions = map[string][]string{
+	StatusPending:  {StatusAccepted, StatusRejected, StatusCancelled, StatusExpired},
+	StatusAccepted: {StatusUnfriended},
+}
+
 //FriendRequest describes a friend request
 type FriendRequest struct {
-	ID         uint      `json:"id"`
-	UserFromID uint      `json:"user_from_id"`
-	UserToID   uint      `json:"user_to_id"`
-	CreatedAt  time.Time `json:"created_at"`
-	AcceptedAt time.Time `json:"accepted_at"`
-	RejectedAt time.Time `json:"rejected_at"`
+	ID          uint      `json:"id"`
+	UserFromID  uint      `json:"user_from_id"`
+	UserToID    uint      `json:"user_to_id"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	AcceptedAt  time.Time `json:"accepted_at"`
+	RejectedAt  time.Time `json:"rejected_at"`
+	CancelledAt time.Time `json:"cancelled_at"`
+	EndedAt     time.Time `json:"ended_at"`
+	EndedBy     uint      `json:"ended_by"`
+	Kind        string    `json:"kind"`
+}
+
+//TransitionError is returned when a request can't move to the given status
+type TransitionError struct {
+	From string
+	To   string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("Request can't move from %s to %s.", e.From, e.To)
+}
+
+func (f *FriendRequest) transition(status string) error {
+	for _, allowed := range requestTransitions[f.Status] {
+		if allowed == status {
+			f.Status = status
+			return nil
+		}
+	}
+	return &TransitionError{From: f.Status, To: status}
 }
 
-func (f *FriendRequest) accept() {
+func (f *FriendRequest) accept() error {
+	if err := f.transition(StatusAccepted); err != nil {
+		return err
+	}
 	f.AcceptedAt = time.Now()
+	return nil
 }
 
-func (f *FriendRequest) reject() {
+func (f *FriendRequest) reject() error {
+	if err := f.transition(StatusRejected); err != nil {
+		return err
+	}
 	f.RejectedAt = time.Now()
+	return nil
+}
+
+func (f *FriendRequest) cancel() error {
+	if err := f.transition(StatusCancelled); err != nil {
+		return err
+	}
+	f.CancelledAt = time.Now()
+	return nil
+}
+
+func (f *FriendRequest) unfriend(userID uint) error {
+	if err := f.transition(StatusUnfriended); err != nil {
+		return err
+	}
+	f.EndedAt = time.Now()
+	f.EndedBy = userID
+	return nil
+}
+
+// friendID returns the other side of the request from userID's point of view.
+func (f *FriendRequest) friendID(userID uint) uint {
+	if f.UserFromID == userID {
+		return f.UserToID
+	}
+	return f.UserFromID
+}
+
+func (f *FriendRequest) expire() error {
+	return f.transition(StatusExpired)
 }
 
 func (f *FriendRequest) save() {
+	f.Status = StatusPending
 	f.CreatedAt = time.Now()
 }
 
+func (f *FriendRequest) isFollow() bool {
+	return f.Kind == KindFollow
+}
+
+func (f *FriendRequest) isPending() bool {
+	return f.Status == StatusPending
+}
+
+// isStale reports whether the request has been pending for longer than ttl.
+func (f *FriendRequest) isStale(ttl time.Duration, now time.Time) bool {
+	return f.isPending() && ttl > 0 && now.Sub(f.CreatedAt) > ttl
+}
+
+// cooldownLeft returns how much longer the sender of a rejected request has
+// to wait before asking again.
+func (f *FriendRequest) cooldownLeft(cooldown time.Duration, now time.Time) time.Duration {
+	if f.Status != StatusRejected {
+		return 0
+	}
+	left := f.RejectedAt.Add(cooldown).Sub(now)
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// senderView returns the request as its sender may see it. A rejection isn't
+// revealed to the sender: the request looks pending until the cooldown ends,
+// after which it is no longer shown at all.
+func (f FriendRequest) senderView(cooldown time.Duration, now time.Time) (FriendRequest, bool) {
+	if f.Status != StatusRejected {
+		return f, true
+	}
+	if f.cooldownLeft(cooldown, now) == 0 {
+		return FriendRequest{}, false
+	}
+	f.Status = StatusPending
+	f.RejectedAt = time.Time{}
+	return f, true
+}
+
+// isActive reports whether the request still stands between the two users,
+// either waiting for an answer or as an accepted friendship.
+func (f *FriendRequest) isActive() bool {
+	return f.Status == StatusPending || f.Status == StatusAccepted
+}
+
 //AddFriend creates a FriendRequest
 func AddFriend(friendFrom, friendTo uint) FriendRequest {
 	request := FriendRequest{
 		UserFromID: friendFrom,
 		UserToID:   friendTo,
+		Kind:       KindFriend,
+	}
+	request.save()
+	return request
+}
+
+//FollowUser creates a follow, which stays pending for the followee to answer
+//when their account is private
+func FollowUser(follower, followee uint, private bool) FriendRequest {
+	request := FriendRequest{
+		UserFromID: follower,
+		UserToID:   followee,
+		Kind:       KindFollow,
 	}
 	request.save()
+	if !private {
+		request.accept()
+	}
 	return request
 }
+
+//Follow describes a user following, or followed by, another user
+type Follow struct {
+	UserID    uint      `json:"user_id"`
+	Since     time.Time `json:"since"`
+	RequestID uint      `json:"request_id"`
+}
+
+//FollowsPage is a page of follows along with the cursor of the next page
+type FollowsPage struct {
+	Follows    []Follow `json:"follows"`
+	NextCursor string   `json:"next_cursor"`
+}
+
+// followsFromRequests turns accepted follow requests into the users on the
+// other side of them from userID.
+func followsFromRequests(userID uint, requests []FriendRequest) []Follow {
+	follows := make([]Follow, 0, len(requests))
+	for _, request := range requests {
+		follows = append(follows, Follow{
+			UserID:    request.friendID(userID),
+			Since:     request.AcceptedAt,
+			RequestID: request.ID,
+		})
+	}
+	return follows
+}
+
+//Friend describes one of a user's friends
+type Friend struct {
+	UserID       uint      `json:"user_id"`
+	FriendsSince time.Time `json:"friends_since"`
+	RequestID    uint      `json:"request_id"`
+	MutualCount  int       `json:"mutual_count"`
+	Nickname     string    `json:"nickname,omitempty"`
+	Note         string    `json:"note,omitempty"`
+	Favorite     bool      `json:"favorite"`
+}
+
+// friendsFromRequests turns userID's accepted requests into their friends.
+func friendsFromRequests(userID uint, requests []FriendRequest) []Friend {
+	friends := make([]Friend, 0, len(requests))
+	for _, request := range requests {
+		friends = append(friends, Friend{
+			UserID:       request.friendID(userID),
+			FriendsSince: request.AcceptedAt,
+			RequestID:    request.ID,
+		})
+	}
+	return friends
+}
+
+//Block describes a user blocking another user
+type Block struct {
+	ID            uint      `json:"id"`
+	UserID        uint      `json:"user_id"`
+	BlockedUserID uint      `json:"blocked_user_id"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+//BlockUser creates a Block
+func BlockUser(userID, blockedUserID uint) Block {
+	return Block{
+		UserID:        userID,
+		BlockedUserID: blockedUserID,
+		CreatedAt:     time.Now(),
+	}
+}
+
+// Who a user accepts friend requests from.
+const (
+	AllowEveryone         = "everyone"
+	AllowFriendsOfFriends = "friends_of_friends"
+	AllowNobody           = "nobody"
+)
+
+//Settings holds a user's friend request preferences
+type Settings struct {
+	UserID            uint   `json:"user_id"`
+	AllowRequestsFrom string `json:"allow_requests_from"`
+	// Private accounts approve each follower.
+	Private bool `json:"private"`
+}
+
+func defaultSettings(userID uint) Settings {
+	return Settings{UserID: userID, AllowRequestsFrom: AllowEveryone}
+}
+
+func (s Settings) valid() bool {
+	switch s.AllowRequestsFrom {
+	case AllowEveryone, AllowFriendsOfFriends, AllowNobody:
+		return true
+	}
+	return false
+}
+
+const maxListNameLength = 64
+
+//FriendList is a named group of a user's friends
+type FriendList struct {
+	ID        uint      `json:"id"`
+	UserID    uint      `json:"user_id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Members   []uint    `json:"members"`
+}
+
+//CreateFriendList creates an empty FriendList
+func CreateFriendList(userID uint, name string) FriendList {
+	return FriendList{
+		UserID:    userID,
+		Name:      strings.TrimSpace(name),
+		CreatedAt: time.Now(),
+		Members:   []uint{},
+	}
+}
+
+func validListName(name string) bool {
+	name = strings.TrimSpace(name)
+	return name != "" && len(name) <= maxListNameLength
+}
+
+func (l FriendList) hasMember(userID uint) bool {
+	for _, member := range l.Members {
+		if member == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *FriendList) removeMember(userID uint) {
+	members := []uint{}
+	for _, member := range l.Members {
+		if member != userID {
+			members = append(members, member)
+		}
+	}
+	l.Members = members
+}
+
+const (
+	maxNicknameLength = 64
+	maxNoteLength     = 1000
+)
+
+//FriendNote is a nickname and note a user keeps about one of their friends.
+//Only the user who wrote it ever sees it.
+type FriendNote struct {
+	UserID    uint      `json:"-"`
+	FriendID  uint      `json:"friend_id"`
+	Nickname  string    `json:"nickname"`
+	Note      string    `json:"note"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (n FriendNote) valid() bool {
+	return utf8.RuneCountInString(n.Nickname) <= maxNicknameLength &&
+		utf8.RuneCountInString(n.Note) <= maxNoteLength
+}
+
+func (n FriendNote) empty() bool {
+	return n.Nickname == "" && n.Note == ""
+}
@@ -6,34 +6,90 @@ import (
 )
 
 func TestFriendRequestAccept(t *testing.T) {
-	friendRequest := FriendRequest{
-		UserFromID: 1,
-		UserToID:   2,
-	}
-	friendRequest.accept()
-	if friendRequest.AcceptedAt.Equal(time.Unix(0, 0)) {
+	friendRequest := AddFriend(1, 2)
+	err := friendRequest.accept()
+	if err != nil || friendRequest.AcceptedAt.IsZero() || friendRequest.Status != StatusAccepted {
 		t.Error("Accept failed")
 	}
 }
 
 func TestFriendRequestReject(t *testing.T) {
-	friendRequest := FriendRequest{
-		UserFromID: 1,
-		UserToID:   2,
-	}
-	friendRequest.reject()
-	if friendRequest.RejectedAt.Equal(time.Unix(0, 0)) {
+	friendRequest := AddFriend(1, 2)
+	err := friendRequest.reject()
+	if err != nil || friendRequest.RejectedAt.IsZero() || friendRequest.Status != StatusRejected {
 		t.Error("Reject failed")
 	}
 }
 
+func TestFriendRequestCancel(t *testing.T) {
+	friendRequest := AddFriend(1, 2)
+	if !friendRequest.isPending() {
+		t.Error("New request should be pending")
+	}
+	err := friendRequest.cancel()
+	if err != nil || friendRequest.CancelledAt.IsZero() || friendRequest.Status != StatusCancelled {
+		t.Error("Cancel failed")
+	}
+}
+
+func TestFriendRequestExpire(t *testing.T) {
+	friendRequest := AddFriend(1, 2)
+	if err := friendRequest.expire(); err != nil || friendRequest.Status != StatusExpired {
+		t.Error("Expire failed")
+	}
+}
+
+func TestFriendRequestUnfriend(t *testing.T) {
+	friendRequest := AddFriend(1, 2)
+	if err := friendRequest.unfriend(2); err == nil {
+		t.Error("A pending request can't be unfriended")
+	}
+	friendRequest.accept()
+	err := friendRequest.unfriend(2)
+	if err != nil || friendRequest.Status != StatusUnfriended ||
+		friendRequest.EndedAt.IsZero() || friendRequest.EndedBy != 2 {
+		t.Error("Unfriend failed")
+	}
+}
+
+func TestFriendRequestFriendID(t *testing.T) {
+	friendRequest := AddFriend(1, 2)
+	if friendRequest.friendID(1) != 2 || friendRequest.friendID(2) != 1 {
+		t.Error("friendID should return the other user")
+	}
+}
+
+func TestFriendRequestIllegalTransitions(t *testing.T) {
+	for _, status := range []string{StatusAccepted, StatusRejected, StatusCancelled,
+		StatusExpired, StatusUnfriended} {
+		friendRequest := AddFriend(1, 2)
+		friendRequest.Status = status
+
+		if err := friendRequest.accept(); err == nil {
+			t.Errorf("Accept from %s should fail", status)
+		}
+		if err := friendRequest.reject(); err == nil {
+			t.Errorf("Reject from %s should fail", status)
+		}
+		if err := friendRequest.cancel(); err == nil {
+			t.Errorf("Cancel from %s should fail", status)
+		}
+		if err := friendRequest.expire(); err == nil {
+			t.Errorf("Expire from %s should fail", status)
+		}
+		if friendRequest.Status != status {
+			t.Errorf("Status changed from %s to %s", status, friendRequest.Status)
+		}
+	}
+}
+
 func TestFriendRequestSave(t *testing.T) {
 	friendRequest := FriendRequest{
 		UserFromID: 1,
 		UserToID:   2,
 	}
 	friendRequest.save()
-	if friendRequest.CreatedAt.Equal(time.Unix(0, 0)) {
+	if friendRequest.CreatedAt.Equal(time.Unix(0, 0)) || friendRequest.Status != StatusPending {
 		t.Error("Save failed")
 	}
 }
@@ -44,3 +100,62 @@ func TestAddFriend(t *testing.T) {
 		t.Error("Friend request creation failed")
 	}
 }
+
+func TestFriendsFromRequests(t *testing.T) {
+	accepted := time.Now()
+	requests := []FriendRequest{
+		{ID: 1, UserFromID: 1, UserToID: 2, AcceptedAt: accepted},
+		{ID: 2, UserFromID: 3, UserToID: 1, AcceptedAt: accepted},
+	}
+	friends := friendsFromRequests(1, requests)
+	if len(friends) != 2 || friends[0].UserID != 2 || friends[1].UserID != 3 {
+		t.Errorf("Unexpected friends %+v", friends)
+	}
+	if friends[1].RequestID != 2 || !friends[1].FriendsSince.Equal(accepted) {
+		t.Errorf("Unexpected friend %+v", friends[1])
+	}
+}
+
+func TestFriendRequestCooldownLeft(t *testing.T) {
+	now := time.Now()
+	friendRequest := AddFriend(1, 2)
+	if friendRequest.cooldownLeft(time.Hour, now) != 0 {
+		t.Error("A pending request has no cooldown")
+	}
+	friendRequest.reject()
+	friendRequest.RejectedAt = now.Add(-15 * time.Minute)
+	if left := friendRequest.cooldownLeft(time.Hour, now); left != 45*time.Minute {
+		t.Errorf("Expected 45m left, got %v", left)
+	}
+	if friendRequest.cooldownLeft(10*time.Minute, now) != 0 {
+		t.Error("Expected the cooldown to be over")
+	}
+}
+
+func TestFriendRequestSenderView(t *testing.T) {
+	now := time.Now()
+	friendRequest := AddFriend(1, 2)
+	friendRequest.reject()
+
+	view, ok := friendRequest.senderView(time.Hour, now)
+	if !ok || view.Status != StatusPending || !view.RejectedAt.IsZero() {
+		t.Errorf("Expected the rejection to be hidden, got %+v", view)
+	}
+	if friendRequest.Status != StatusRejected {
+		t.Error("senderView must not change the request itself")
+	}
+	if _, ok = friendRequest.senderView(time.Hour, now.Add(2*time.Hour)); ok {
+		t.Error("Expected the request to be hidden once the cooldown is over")
+	}
+}
+
+func TestFollowUser(t *testing.T) {
+	public := FollowUser(1, 2, false)
+	if public.Kind != KindFollow || public.Status != StatusAccepted || public.AcceptedAt.IsZero() {
+		t.Errorf("expected following a public account to be accepted, got %+v", public)
+	}
+	private := FollowUser(1, 2, true)
+	if private.Kind != KindFollow || !private.isPending() {
+		t.Errorf("expected following a private account to be pending, got %+v", private)
+	}
+}
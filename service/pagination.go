@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sort orders accepted by the listing endpoints. "since" is when the
+// friendship started for friend listings and when the request was sent for
+// request listings; "user_id" is the id of the other user.
+const (
+	sortSinceAsc  = "since"
+	sortSinceDesc = "-since"
+	sortUserID    = "user_id"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+var errInvalidPage = errors.New("Invalid page parameters")
+
+//Page describes which slice of a listing to return. Listings are paged by
+//keyset: each page starts right after the sort key and id of the last row of
+//the previous page.
+type Page struct {
+	Limit int
+	Sort  string
+	// AfterKey and AfterID hold the position of the cursor, if any.
+	AfterKey int64
+	AfterID  uint
+	HasAfter bool
+}
+
+//FriendsPage is a page of friends along with the cursor of the next page
+type FriendsPage struct {
+	Friends    []Friend `json:"friends"`
+	NextCursor string   `json:"next_cursor"`
+}
+
+//RequestsPage is a page of friend requests along with the cursor of the next page
+type RequestsPage struct {
+	Requests   []FriendRequest `json:"requests"`
+	NextCursor string          `json:"next_cursor"`
+}
+
+func defaultPage() Page {
+	return Page{Limit: defaultPageLimit, Sort: sortSinceDesc}
+}
+
+// parsePage reads the limit, sort and cursor query parameters.
+func parsePage(req *http.Request) (Page, error) {
+	page := defaultPage()
+	query := req.URL.Query()
+
+	if limit := query.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value <= 0 || value > maxPageLimit {
+			return Page{}, errInvalidPage
+		}
+		page.Limit = value
+	}
+
+	if order := query.Get("sort"); order != "" {
+		if order != sortSinceAsc && order != sortSinceDesc && order != sortUserID {
+			return Page{}, errInvalidPage
+		}
+		page.Sort = order
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		order, key, id, err := decodeCursor(cursor)
+		if err != nil || order != page.Sort {
+			return Page{}, errInvalidPage
+		}
+		page.AfterKey, page.AfterID, page.HasAfter = key, id, true
+	}
+	return page, nil
+}
+
+func (p Page) descending() bool {
+	return p.Sort == sortSinceDesc
+}
+
+// key returns the value request is sorted on within userID's listing, where
+// since picks the timestamp the listing is ordered by.
+func (p Page) key(userID uint, request FriendRequest, since func(FriendRequest) time.Time) int64 {
+	if p.Sort == sortUserID {
+		return int64(request.friendID(userID))
+	}
+	return since(request).UnixNano()
+}
+
+// follows reports whether a row with the given key and id comes after the
+// cursor in the page's sort order.
+func (p Page) follows(key int64, id uint) bool {
+	if key == p.AfterKey {
+		return (id > p.AfterID) != p.descending() && id != p.AfterID
+	}
+	return (key > p.AfterKey) != p.descending()
+}
+
+// afterValue returns the cursor key in the form the database compares it.
+func (p Page) afterValue() interface{} {
+	if p.Sort == sortUserID {
+		return p.AfterKey
+	}
+	return time.Unix(0, p.AfterKey).UTC()
+}
+
+// nextCursor returns the cursor for the page following requests, or "" when
+// requests didn't fill the page.
+func (p Page) nextCursor(userID uint, requests []FriendRequest, since func(FriendRequest) time.Time) string {
+	if len(requests) < p.Limit || len(requests) == 0 {
+		return ""
+	}
+	last := requests[len(requests)-1]
+	return encodeCursor(p.Sort, p.key(userID, last, since), last.ID)
+}
+
+func friendsSince(request FriendRequest) time.Time {
+	return request.AcceptedAt
+}
+
+func requestedSince(request FriendRequest) time.Time {
+	return request.CreatedAt
+}
+
+func encodeCursor(order string, key int64, id uint) string {
+	raw := fmt.Sprintf("%s|%d|%d", order, key, id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor string) (string, int64, uint, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 {
+		return "", 0, 0, errInvalidPage
+	}
+	key, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	id, err := strconv.ParseUint(parts[2], 10, 32)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return parts[0], key, uint(id), nil
+}
+
+// eachRequest walks every page of one of userID's listings, calling fn with
+// each request.
+func eachRequest(ctx context.Context, userID uint,
+	list func(ctx context.Context, userID uint, page Page) ([]FriendRequest, error),
+	since func(FriendRequest) time.Time, fn func(request FriendRequest)) error {
+	page := Page{Limit: maxPageLimit, Sort: sortSinceAsc}
+	for {
+		requests, err := list(ctx, userID, page)
+		if err != nil {
+			return err
+		}
+		for _, request := range requests {
+			fn(request)
+		}
+		if len(requests) < page.Limit {
+			return nil
+		}
+		last := requests[len(requests)-1]
+		page.AfterKey = page.key(userID, last, since)
+		page.AfterID = last.ID
+		page.HasAfter = true
+	}
+}
+
+type keyedRequests struct {
+	requests   []FriendRequest
+	keys       []int64
+	descending bool
+}
+
+func (k keyedRequests) Len() int { return len(k.requests) }
+
+func (k keyedRequests) Swap(i, j int) {
+	k.requests[i], k.requests[j] = k.requests[j], k.requests[i]
+	k.keys[i], k.keys[j] = k.keys[j], k.keys[i]
+}
+
+func (k keyedRequests) Less(i, j int) bool {
+	if k.keys[i] != k.keys[j] {
+		return (k.keys[i] < k.keys[j]) != k.descending
+	}
+	return (k.requests[i].ID < k.requests[j].ID) != k.descending
+}
+
+// paginateRequests applies page to userID's requests in memory, for
+// backends that can't do it in a query.
+func paginateRequests(userID uint, requests []FriendRequest, page Page,
+	since func(FriendRequest) time.Time) []FriendRequest {
+	sorted := keyedRequests{descending: page.descending()}
+	for _, request := range requests {
+		key := page.key(userID, request, since)
+		if page.HasAfter && !page.follows(key, request.ID) {
+			continue
+		}
+		sorted.requests = append(sorted.requests, request)
+		sorted.keys = append(sorted.keys, key)
+	}
+	sort.Sort(sorted)
+	if len(sorted.requests) > page.Limit {
+		return sorted.requests[:page.Limit]
+	}
+	return sorted.requests
+}
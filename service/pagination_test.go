@@ -0,0 +1,112 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newPagingTestDatabase makes user 1 friends with users 2 to 6, where the
+// friendship with user n started n hours ago.
+func newPagingTestDatabase() *memoryDatabase {
+	database := newTokenTestDatabase(map[string]string{"TEST": "1"})
+	now := time.Now()
+	for id := uint(2); id <= 6; id++ {
+		database.insertFriendRequest(ctx, FriendRequest{
+			ID:         id,
+			UserFromID: 1,
+			UserToID:   id,
+			Status:     StatusAccepted,
+			AcceptedAt: now.Add(-time.Duration(id) * time.Hour),
+		})
+	}
+	return database
+}
+
+func walkFriendPages(t *testing.T, database *memoryDatabase, order string) []uint {
+	server := MakeTestServer(database)
+	var ids []uint
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		query := url.Values{"limit": {"2"}, "sort": {order}}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+		recorder := serveTestRequest(server, "GET", "/friends?"+query.Encode(), "TEST")
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Expected %v; received %v", http.StatusOK, recorder.Code)
+		}
+		var page FriendsPage
+		json.Unmarshal(recorder.Body.Bytes(), &page)
+		for _, friend := range page.Friends {
+			ids = append(ids, friend.UserID)
+		}
+		if page.NextCursor == "" {
+			return ids
+		}
+		cursor = page.NextCursor
+	}
+	t.Fatal("Paging never finished")
+	return nil
+}
+
+func TestFriendsPagination(t *testing.T) {
+	for order, expected := range map[string][]uint{
+		sortSinceDesc: {2, 3, 4, 5, 6},
+		sortSinceAsc:  {6, 5, 4, 3, 2},
+		sortUserID:    {2, 3, 4, 5, 6},
+	} {
+		ids := walkFriendPages(t, newPagingTestDatabase(), order)
+		if len(ids) != len(expected) {
+			t.Errorf("%s: expected %v, got %v", order, expected, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != expected[i] {
+				t.Errorf("%s: expected %v, got %v", order, expected, ids)
+				break
+			}
+		}
+	}
+}
+
+func TestFriendsPaginationTies(t *testing.T) {
+	database := newPagingTestDatabase()
+	since := time.Now()
+	for i := range database.requests {
+		database.requests[i].AcceptedAt = since
+	}
+
+	ids := walkFriendPages(t, database, sortSinceAsc)
+	if len(ids) != 5 || ids[0] != 2 || ids[4] != 6 {
+		t.Errorf("Expected rows with equal timestamps to page by id, got %v", ids)
+	}
+}
+
+func TestFriendsPaginationInvalidParameters(t *testing.T) {
+	server := MakeTestServer(newPagingTestDatabase())
+	cursor := encodeCursor(sortUserID, 3, 3)
+
+	for _, query := range []string{
+		"limit=0",
+		"limit=abc",
+		"limit=1000",
+		"sort=name",
+		"cursor=not-a-cursor",
+		"sort=since&cursor=" + cursor,
+	} {
+		recorder := serveTestRequest(server, "GET", "/friends?"+query, "TEST")
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %v; received %v", query, http.StatusBadRequest, recorder.Code)
+		}
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	order, key, id, err := decodeCursor(encodeCursor(sortSinceDesc, -42, 7))
+	if err != nil || order != sortSinceDesc || key != -42 || id != 7 {
+		t.Errorf("Cursor did not round trip: %s %d %d %v", order, key, id, err)
+	}
+}
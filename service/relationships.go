@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+const maxRelationshipBatch = 500
+
+// Relationship statuses, from the point of view of the user asking.
+const (
+	RelationshipFriend          = "friend"
+	RelationshipPendingIncoming = "pending_incoming"
+	RelationshipPendingOutgoing = "pending_outgoing"
+	RelationshipBlocked         = "blocked"
+	RelationshipNone            = "none"
+)
+
+//Relationship describes how the viewer is related to another user
+type Relationship struct {
+	UserID   uint   `json:"user_id"`
+	Status   string `json:"status"`
+	Favorite bool   `json:"favorite"`
+}
+
+//RelationshipsRequest lists the users to look up relationships with
+type RelationshipsRequest struct {
+	UserIDs []uint `json:"user_ids"`
+}
+
+// resolveRelationships looks up how viewerID is related to each of userIDs
+// using a fixed number of queries however many users are asked about. Being
+// blocked by someone reads as no relationship, and rejections of the viewer's
+// own requests stay hidden the same way they are in their outgoing listing.
+func resolveRelationships(ctx context.Context, viewerID uint, userIDs []uint, cooldown time.Duration,
+	database Database) ([]Relationship, error) {
+	relationships := make([]Relationship, 0, len(userIDs))
+	if len(userIDs) == 0 {
+		return relationships, nil
+	}
+
+	blocks, err := database.getBlocksInvolvingUser(ctx, viewerID)
+	if err != nil {
+		return relationships, err
+	}
+	blocked := map[uint]bool{}
+	for _, block := range blocks {
+		if block.UserID == viewerID {
+			blocked[block.BlockedUserID] = true
+		}
+	}
+
+	favorites, err := database.getFavorites(ctx, viewerID)
+	if err != nil {
+		return relationships, err
+	}
+
+	requests, err := database.getRequestsBetween(ctx, viewerID, userIDs)
+	if err != nil {
+		return relationships, err
+	}
+	latest := map[uint]FriendRequest{}
+	for _, request := range requests {
+		otherID := request.friendID(viewerID)
+		if current, ok := latest[otherID]; !ok || request.CreatedAt.After(current.CreatedAt) {
+			latest[otherID] = request
+		}
+	}
+
+	now := time.Now()
+	for _, userID := range userIDs {
+		status := RelationshipNone
+		request, ok := latest[userID]
+		if ok && request.UserFromID == viewerID {
+			request, ok = request.senderView(cooldown, now)
+		}
+		switch {
+		case blocked[userID]:
+			status = RelationshipBlocked
+		case !ok:
+		case request.Status == StatusAccepted:
+			status = RelationshipFriend
+		case request.Status == StatusPending && request.UserFromID == viewerID:
+			status = RelationshipPendingOutgoing
+		case request.Status == StatusPending:
+			status = RelationshipPendingIncoming
+		}
+		relationships = append(relationships, Relationship{
+			UserID:   userID,
+			Status:   status,
+			Favorite: status == RelationshipFriend && containsID(favorites, userID),
+		})
+	}
+	return relationships, nil
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingDatabase counts the lookups a batch relationship query makes.
+type countingDatabase struct {
+	Database
+	queries int
+}
+
+func (c *countingDatabase) getFriendRequestByUserFromAndTo(ctx context.Context, userFrom, userTo uint) (FriendRequest, error) {
+	c.queries++
+	return c.Database.getFriendRequestByUserFromAndTo(ctx, userFrom, userTo)
+}
+
+func (c *countingDatabase) getBlockBetween(ctx context.Context, userA, userB uint) (Block, error) {
+	c.queries++
+	return c.Database.getBlockBetween(ctx, userA, userB)
+}
+
+func (c *countingDatabase) getRequestsBetween(ctx context.Context, userID uint, otherIDs []uint) ([]FriendRequest, error) {
+	c.queries++
+	return c.Database.getRequestsBetween(ctx, userID, otherIDs)
+}
+
+func (c *countingDatabase) getFavorites(ctx context.Context, userID uint) ([]uint, error) {
+	c.queries++
+	return c.Database.getFavorites(ctx, userID)
+}
+
+func (c *countingDatabase) getBlocksInvolvingUser(ctx context.Context, userID uint) ([]Block, error) {
+	c.queries++
+	return c.Database.getBlocksInvolvingUser(ctx, userID)
+}
+
+func newRelationshipTestDatabase() *memoryDatabase {
+	database := newTokenTestDatabase(map[string]string{"TEST": "1"})
+	now := time.Now()
+	for _, request := range []FriendRequest{
+		{ID: 1, UserFromID: 2, UserToID: 1, Status: StatusAccepted},
+		{ID: 2, UserFromID: 3, UserToID: 1, Status: StatusPending},
+		{ID: 3, UserFromID: 1, UserToID: 4, Status: StatusPending},
+		{ID: 4, UserFromID: 1, UserToID: 7, Status: StatusRejected, RejectedAt: now},
+		{ID: 5, UserFromID: 8, UserToID: 1, Status: StatusRejected, RejectedAt: now},
+		{ID: 6, UserFromID: 1, UserToID: 9, Status: StatusUnfriended},
+	} {
+		database.insertFriendRequest(ctx, request)
+	}
+	database.insertBlock(ctx, BlockUser(1, 5))
+	database.insertBlock(ctx, BlockUser(6, 1))
+	return database
+}
+
+func TestResolveRelationships(t *testing.T) {
+	database := &countingDatabase{Database: newRelationshipTestDatabase()}
+	userIDs := []uint{2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	relationships, err := resolveRelationships(ctx, 1, userIDs, time.Hour, database)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		RelationshipFriend,
+		RelationshipPendingIncoming,
+		RelationshipPendingOutgoing,
+		RelationshipBlocked,
+		RelationshipNone,
+		RelationshipPendingOutgoing,
+		RelationshipNone,
+		RelationshipNone,
+		RelationshipNone,
+	}
+	for i, relationship := range relationships {
+		if relationship.UserID != userIDs[i] || relationship.Status != expected[i] {
+			t.Errorf("User %d: expected %s, got %+v", userIDs[i], expected[i], relationship)
+		}
+	}
+	if database.queries != 3 {
+		t.Errorf("Expected 3 queries, got %d", database.queries)
+	}
+}
+
+func TestRelationshipsBatchHandler(t *testing.T) {
+	var relationships []Relationship
+
+	server := MakeTestServer(newRelationshipTestDatabase())
+	recorder := serveTestJSON(server, "POST", "/relationships/batch", "TEST", "{\"user_ids\": [2, 4, 10]}")
+	json.Unmarshal(recorder.Body.Bytes(), &relationships)
+
+	if recorder.Code != http.StatusOK || len(relationships) != 3 {
+		t.Fatalf("Expected 3 relationships, got %v %+v", recorder.Code, relationships)
+	}
+	if relationships[1].UserID != 4 || relationships[1].Status != RelationshipPendingOutgoing {
+		t.Errorf("Unexpected relationship %+v", relationships[1])
+	}
+
+	ids := make([]string, maxRelationshipBatch+1)
+	for i := range ids {
+		ids[i] = fmt.Sprint(i + 2)
+	}
+	for _, body := range []string{"not json", "{\"user_ids\": [" + strings.Join(ids, ",") + "]}"} {
+		recorder = serveTestJSON(server, "POST", "/relationships/batch", "TEST", body)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("Expected %v; received %v", http.StatusBadRequest, recorder.Code)
+		}
+	}
+}
+
+func TestResolveRelationshipsFlagsFavorites(t *testing.T) {
+	database := newRelationshipTestDatabase()
+	database.insertFavorite(ctx, 1, 2)
+	// A stale favorite for someone who is no longer a friend isn't reported.
+	database.insertFavorite(ctx, 1, 9)
+
+	relationships, err := resolveRelationships(ctx, 1, []uint{2, 9, 3}, time.Hour, database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []bool{true, false, false} {
+		if relationships[i].Favorite != expected {
+			t.Errorf("User %d: expected favorite %v, got %+v", relationships[i].UserID, expected, relationships[i])
+		}
+	}
+}
@@ -1,29 +1,100 @@
 package service
 
 import (
+	"context"
+	"strconv"
+
 	"github.com/gorilla/mux"
 	"github.com/unrolled/render"
 	"github.com/urfave/negroni"
 )
 
+//Server is the friends HTTP handler along with the background work it runs
+type Server struct {
+	*negroni.Negroni
+	sweeper *requestSweeper
+}
+
 // NewServer configures and returns a server.
-func NewServer() *negroni.Negroni {
+func NewServer(config Config) *Server {
 	formatter := render.New(render.Options{
 		IndentJSON: true,
 	})
 
+	db := newDatabase(config)
+	database := withDecisionInvalidation(withRequestExpiry(
+		withDeadlines(db, config.OperationTimeout), config.RequestTTL), config.CanMessageCacheTTL)
 	n := negroni.Classic()
-	n.Use(negroni.HandlerFunc(AuthMiddleware))
+	n.Use(AuthMiddleware(database, config.ServiceTokens))
 	mx := mux.NewRouter()
-	db := &dataHandler{}
-	initRoutes(mx, formatter, db)
+	initRoutes(mx, formatter, database, config)
 	n.UseHandler(mx)
-	return n
+
+	server := &Server{Negroni: n}
+	if config.RequestTTL > 0 {
+		server.sweeper = startRequestSweeper(db, config.RequestTTL, config.SweepInterval,
+			config.OperationTimeout)
+	}
+	return server
+}
+
+// newDatabase returns the backend config asks for. The SQL backends use the
+// shared DB and REDIS connections.
+func newDatabase(config Config) Database {
+	switch config.Backend {
+	case BackendSQLite:
+		return &dataHandler{dialect: sqliteDialect}
+	case BackendPostgres:
+		return &dataHandler{}
+	}
+	memory := newMemoryDatabase()
+	for token, userID := range config.MemoryTokens {
+		memory.redisSetValue(context.Background(), token, strconv.FormatUint(uint64(userID), 10), 0)
+	}
+	return memory
+}
+
+// Close stops the background work started by NewServer.
+func (s *Server) Close() {
+	if s.sweeper != nil {
+		s.sweeper.Stop()
+	}
 }
 
-func initRoutes(mx *mux.Router, formatter *render.Render, database Database) {
-	mx.HandleFunc("/friends/request", postAddFriendHandler(formatter, database)).Methods("POST")
+func initRoutes(mx *mux.Router, formatter *render.Render, database Database, config Config) {
+	mx.HandleFunc("/friends/request", postAddFriendHandler(formatter, database, config)).Methods("POST")
 	mx.HandleFunc("/friends/{request_id}/reject", rejectRequestHandler(formatter, database)).Methods("PUT")
 	mx.HandleFunc("/friends/{request_id}/accept", acceptRequestHandler(formatter, database)).Methods("PUT")
+	mx.HandleFunc("/friends/requests/incoming", getIncomingRequestsHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/friends/requests/outgoing", getOutgoingRequestsHandler(formatter, database, config)).Methods("GET")
+	mx.HandleFunc("/friends/requests/{request_id:[0-9]+}", cancelRequestHandler(formatter, database)).Methods("DELETE")
+	mx.HandleFunc("/friends/{user_id:[0-9]+}", unfriendHandler(formatter, database)).Methods("DELETE")
+	mx.HandleFunc("/friends/lists", getFriendListsHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/friends/lists", postFriendListHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/friends/lists/{list_id:[0-9]+}", getFriendListHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/friends/lists/{list_id:[0-9]+}", putFriendListHandler(formatter, database)).Methods("PUT")
+	mx.HandleFunc("/friends/lists/{list_id:[0-9]+}", deleteFriendListHandler(formatter, database)).Methods("DELETE")
+	mx.HandleFunc("/friends/lists/{list_id:[0-9]+}/members/{user_id:[0-9]+}", putFriendListMemberHandler(formatter, database)).Methods("PUT")
+	mx.HandleFunc("/friends/lists/{list_id:[0-9]+}/members/{user_id:[0-9]+}", deleteFriendListMemberHandler(formatter, database)).Methods("DELETE")
+	mx.HandleFunc("/friends/settings", getSettingsHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/friends/settings", putSettingsHandler(formatter, database)).Methods("PUT")
+	mx.HandleFunc("/friends/suggestions", getSuggestionsHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/friends/suggestions/{user_id:[0-9]+}/dismiss", dismissSuggestionHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/friends/path/{user_id:[0-9]+}", getFriendPathHandler(formatter, database, config)).Methods("GET")
+	mx.HandleFunc("/friends/{user_id:[0-9]+}/favorite", putFavoriteHandler(formatter, database, config)).Methods("PUT")
+	mx.HandleFunc("/friends/{user_id:[0-9]+}/favorite", deleteFavoriteHandler(formatter, database)).Methods("DELETE")
+	mx.HandleFunc("/friends/{user_id:[0-9]+}/note", putFriendNoteHandler(formatter, database)).Methods("PUT")
+	mx.HandleFunc("/friends/{user_id:[0-9]+}/note", deleteFriendNoteHandler(formatter, database)).Methods("DELETE")
+	mx.HandleFunc("/friends/{user_id:[0-9]+}/mutual", getMutualFriendsHandler(formatter, database)).Methods("GET")
 	mx.HandleFunc("/friends", getFriendsHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/follows/{user_id:[0-9]+}", postFollowHandler(formatter, database, config)).Methods("POST")
+	mx.HandleFunc("/follows/{user_id:[0-9]+}", deleteFollowHandler(formatter, database)).Methods("DELETE")
+	mx.HandleFunc("/follows/requests", getFollowRequestsHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/followers", getFollowersHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/following", getFollowingHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/relationships/batch", postRelationshipsBatchHandler(formatter, database, config)).Methods("POST")
+	mx.HandleFunc("/authz/can-message", getCanMessageHandler(formatter, database, config)).Methods("GET")
+	mx.HandleFunc("/blocks", postBlockHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/blocks", getBlocksHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/blocks/{user_id:[0-9]+}", deleteBlockHandler(formatter, database)).Methods("DELETE")
 }
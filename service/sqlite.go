@@ -0,0 +1,168 @@
+package service
+
+import (
+	"database/sql"
+
+	// Registers the sqlite3 driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteDialect runs the dataHandler queries on SQLite, which understands the
+// same upserts as Postgres but numbers its placeholders ?1 rather than $1. The
+// SQLite bundled with the go-sqlite3 release pinned in glide.yaml predates
+// RETURNING.
+var sqliteDialect = sqlDialect{questionPlaceholders: true, lastInsertID: true, migrations: sqliteMigrations}
+
+//InitSQLite opens the SQLite database at path, creating it if it doesn't
+//exist. ":memory:" opens a database that lives as long as the process.
+func InitSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=1&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time, and every connection to :memory:
+	// would get a database of its own.
+	db.SetMaxOpenConns(1)
+	return db, db.Ping()
+}
+
+// sqliteMigrations mirror postgresMigrations version for version.
+var sqliteMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_friend_requests",
+		Up: `CREATE TABLE friend_requests (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_from_id INTEGER NOT NULL,
+			user_to_id   INTEGER NOT NULL,
+			status       VARCHAR(16) NOT NULL DEFAULT 'pending'
+			             CHECK (status IN ('pending', 'accepted', 'rejected', 'cancelled',
+			                               'expired', 'unfriended')),
+			created_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			accepted_at  TIMESTAMP,
+			rejected_at  TIMESTAMP,
+			cancelled_at TIMESTAMP,
+			ended_at     TIMESTAMP,
+			ended_by     INTEGER
+		);
+		CREATE INDEX friend_requests_user_from_idx
+			ON friend_requests (user_from_id, status, created_at, id);
+		CREATE INDEX friend_requests_user_to_idx
+			ON friend_requests (user_to_id, status, created_at, id);`,
+		Down: `DROP TABLE friend_requests;`,
+	},
+	{
+		Version: 2,
+		Name:    "create_blocks",
+		Up: `CREATE TABLE blocks (
+			id              INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id         INTEGER NOT NULL,
+			blocked_user_id INTEGER NOT NULL,
+			created_at      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (user_id, blocked_user_id)
+		);`,
+		Down: `DROP TABLE blocks;`,
+	},
+	{
+		Version: 3,
+		Name:    "create_user_settings",
+		Up: `CREATE TABLE user_settings (
+			user_id             INTEGER PRIMARY KEY,
+			allow_requests_from VARCHAR(32) NOT NULL DEFAULT 'everyone'
+			                    CHECK (allow_requests_from IN ('everyone', 'friends_of_friends', 'nobody'))
+		);`,
+		Down: `DROP TABLE user_settings;`,
+	},
+	{
+		Version: 4,
+		Name:    "create_dismissed_suggestions",
+		Up: `CREATE TABLE dismissed_suggestions (
+			user_id           INTEGER NOT NULL,
+			dismissed_user_id INTEGER NOT NULL,
+			created_at        TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, dismissed_user_id)
+		);`,
+		Down: `DROP TABLE dismissed_suggestions;`,
+	},
+	{
+		Version: 5,
+		Name:    "create_friend_lists",
+		Up: `CREATE TABLE friend_lists (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id    INTEGER NOT NULL,
+			name       VARCHAR(64) NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (user_id, name)
+		);
+		CREATE TABLE friend_list_members (
+			list_id   INTEGER NOT NULL REFERENCES friend_lists (id) ON DELETE CASCADE,
+			member_id INTEGER NOT NULL,
+			PRIMARY KEY (list_id, member_id)
+		);`,
+		Down: `DROP TABLE friend_list_members;
+		DROP TABLE friend_lists;`,
+	},
+	{
+		Version: 6,
+		Name:    "create_friend_notes",
+		Up: `CREATE TABLE friend_notes (
+			user_id    INTEGER NOT NULL,
+			friend_id  INTEGER NOT NULL,
+			nickname   VARCHAR(64) NOT NULL DEFAULT '',
+			note       TEXT NOT NULL DEFAULT '',
+			updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, friend_id)
+		);`,
+		Down: `DROP TABLE friend_notes;`,
+	},
+	{
+		Version: 7,
+		Name:    "create_favorites",
+		Up: `CREATE TABLE favorites (
+			user_id    INTEGER NOT NULL,
+			friend_id  INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, friend_id)
+		);`,
+		Down: `DROP TABLE favorites;`,
+	},
+	{
+		Version: 8,
+		Name:    "add_follows",
+		Up: `ALTER TABLE friend_requests ADD COLUMN kind VARCHAR(16) NOT NULL DEFAULT 'friend'
+			CHECK (kind IN ('friend', 'follow'));
+		ALTER TABLE user_settings ADD COLUMN private BOOLEAN NOT NULL DEFAULT 0;`,
+		// SQLite before 3.35 can't drop columns, so the tables are rebuilt
+		// without them.
+		Down: `CREATE TABLE user_settings_old (
+			user_id             INTEGER PRIMARY KEY,
+			allow_requests_from VARCHAR(32) NOT NULL DEFAULT 'everyone'
+			                    CHECK (allow_requests_from IN ('everyone', 'friends_of_friends', 'nobody'))
+		);
+		INSERT INTO user_settings_old SELECT user_id, allow_requests_from FROM user_settings;
+		DROP TABLE user_settings;
+		ALTER TABLE user_settings_old RENAME TO user_settings;
+		CREATE TABLE friend_requests_old (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_from_id INTEGER NOT NULL,
+			user_to_id   INTEGER NOT NULL,
+			status       VARCHAR(16) NOT NULL DEFAULT 'pending'
+			             CHECK (status IN ('pending', 'accepted', 'rejected', 'cancelled',
+			                               'expired', 'unfriended')),
+			created_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			accepted_at  TIMESTAMP,
+			rejected_at  TIMESTAMP,
+			cancelled_at TIMESTAMP,
+			ended_at     TIMESTAMP,
+			ended_by     INTEGER
+		);
+		INSERT INTO friend_requests_old SELECT id, user_from_id, user_to_id, status, created_at,
+			accepted_at, rejected_at, cancelled_at, ended_at, ended_by FROM friend_requests;
+		DROP TABLE friend_requests;
+		ALTER TABLE friend_requests_old RENAME TO friend_requests;
+		CREATE INDEX friend_requests_user_from_idx
+			ON friend_requests (user_from_id, status, created_at, id);
+		CREATE INDEX friend_requests_user_to_idx
+			ON friend_requests (user_to_id, status, created_at, id);`,
+	},
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"testing"
+)
+
+// newSQLiteDatabase returns a dataHandler on a fresh, fully migrated SQLite
+// database in memory, along with a func that closes it.
+func newSQLiteDatabase(t *testing.T) (*dataHandler, func()) {
+	db, err := InitSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = MigrateUp(db, BackendSQLite); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	return &dataHandler{db: db, dialect: sqliteDialect}, func() { db.Close() }
+}
+
+func TestRebind(t *testing.T) {
+	query := `SELECT 1 WHERE a=$1 AND (b=$2 OR c=$1) AND d IN ($10)`
+	if rebound := postgresDialect.rebind(query); rebound != query {
+		t.Errorf("Expected Postgres queries to be left alone, got %s", rebound)
+	}
+	expected := `SELECT 1 WHERE a=?1 AND (b=?2 OR c=?1) AND d IN (?10)`
+	if rebound := sqliteDialect.rebind(query); rebound != expected {
+		t.Errorf("Expected %s, got %s", expected, rebound)
+	}
+}
+
+func TestSQLiteMigrationsRoundTrip(t *testing.T) {
+	database, closeDatabase := newSQLiteDatabase(t)
+	defer closeDatabase()
+	if err := CheckSchemaVersion(database.db, BackendSQLite); err != nil {
+		t.Fatal(err)
+	}
+	reverted, err := MigrateDown(database.db, BackendSQLite, len(sqliteMigrations))
+	if err != nil || len(reverted) != len(sqliteMigrations) {
+		t.Fatalf("Expected every migration to be reverted, got %d (%v)", len(reverted), err)
+	}
+	if version, _ := SchemaVersion(database.db); version != 0 {
+		t.Errorf("Expected version 0 after reverting everything, got %d", version)
+	}
+	if _, err = MigrateUp(database.db, BackendSQLite); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+const (
+	defaultSuggestionLimit = 20
+	maxSuggestionLimit     = 100
+)
+
+//Suggestion is a user the caller may know through their friends
+type Suggestion struct {
+	UserID        uint      `json:"user_id"`
+	MutualCount   int       `json:"mutual_count"`
+	MutualFriends []uint    `json:"mutual_friends"`
+	LatestMutual  time.Time `json:"latest_mutual"`
+}
+
+// suggestFriends ranks the friends of userID's friends by how many friends
+// they share with userID, then by how recently the newest of those
+// friendships started. Friends, blocked users in either direction, users with
+// a pending request either way and dismissed suggestions are left out.
+func suggestFriends(ctx context.Context, userID uint, limit int, database Database) ([]Suggestion, error) {
+	graph, err := loadFriendGraph(ctx, []uint{userID}, database)
+	if err != nil {
+		return []Suggestion{}, err
+	}
+	friendIDs := graph.friendIDs(userID)
+	graph, err = loadFriendGraph(ctx, append(friendIDs, userID), database)
+	if err != nil {
+		return []Suggestion{}, err
+	}
+
+	excluded, err := excludedSuggestions(ctx, userID, database)
+	if err != nil {
+		return []Suggestion{}, err
+	}
+	excluded[userID] = true
+	for _, friendID := range friendIDs {
+		excluded[friendID] = true
+	}
+
+	candidates := map[uint]*Suggestion{}
+	for _, friendID := range friendIDs {
+		for candidateID, request := range graph[friendID] {
+			if excluded[candidateID] {
+				continue
+			}
+			candidate, ok := candidates[candidateID]
+			if !ok {
+				candidate = &Suggestion{UserID: candidateID}
+				candidates[candidateID] = candidate
+			}
+			candidate.MutualCount++
+			candidate.MutualFriends = append(candidate.MutualFriends, friendID)
+			if request.AcceptedAt.After(candidate.LatestMutual) {
+				candidate.LatestMutual = request.AcceptedAt
+			}
+		}
+	}
+
+	suggestions := make(rankedSuggestions, 0, len(candidates))
+	for _, candidate := range candidates {
+		suggestions = append(suggestions, *candidate)
+	}
+	sort.Sort(suggestions)
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions, nil
+}
+
+// excludedSuggestions returns the users that must never be suggested to userID
+// apart from their friends.
+func excludedSuggestions(ctx context.Context, userID uint, database Database) (map[uint]bool, error) {
+	excluded := map[uint]bool{}
+
+	blocks, err := database.getBlocksInvolvingUser(ctx, userID)
+	if err != nil {
+		return excluded, err
+	}
+	for _, block := range blocks {
+		excluded[block.UserID] = true
+		excluded[block.BlockedUserID] = true
+	}
+
+	dismissed, err := database.getDismissedSuggestions(ctx, userID)
+	if err != nil {
+		return excluded, err
+	}
+	for _, dismissedID := range dismissed {
+		excluded[dismissedID] = true
+	}
+
+	exclude := func(request FriendRequest) {
+		excluded[request.friendID(userID)] = true
+	}
+	err = eachRequest(ctx, userID, database.getPendingRequestsToUser, requestedSince, exclude)
+	if err != nil {
+		return excluded, err
+	}
+	// Users who ever rejected a request stay out of the suggestions.
+	outgoing := func(ctx context.Context, userID uint, page Page) ([]FriendRequest, error) {
+		return database.getPendingRequestsFromUser(ctx, userID, time.Time{}, page)
+	}
+	err = eachRequest(ctx, userID, outgoing, requestedSince, exclude)
+	return excluded, err
+}
+
+type rankedSuggestions []Suggestion
+
+func (r rankedSuggestions) Len() int      { return len(r) }
+func (r rankedSuggestions) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+
+func (r rankedSuggestions) Less(i, j int) bool {
+	if r[i].MutualCount != r[j].MutualCount {
+		return r[i].MutualCount > r[j].MutualCount
+	}
+	if !r[i].LatestMutual.Equal(r[j].LatestMutual) {
+		return r[i].LatestMutual.After(r[j].LatestMutual)
+	}
+	return r[i].UserID < r[j].UserID
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func getSuggestionIDs(t *testing.T, database *memoryDatabase) []uint {
+	var suggestions []Suggestion
+	recorder := serveTestRequest(MakeTestServer(database), "GET", "/friends/suggestions", "U1")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &suggestions)
+	ids := []uint{}
+	for _, suggestion := range suggestions {
+		ids = append(ids, suggestion.UserID)
+	}
+	return ids
+}
+
+func sameIDs(a, b []uint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSuggestionsRankByMutualFriendsThenRecency(t *testing.T) {
+	database := newGraphTestDatabase()
+	database.insertFriendRequest(ctx, FriendRequest{ID: 9, UserFromID: 8, UserToID: 2,
+		Status: StatusAccepted, AcceptedAt: time.Now()})
+
+	if ids := getSuggestionIDs(t, database); !sameIDs(ids, []uint{5, 8, 6}) {
+		t.Errorf("Expected suggestions [5 8 6], got %v", ids)
+	}
+
+	suggestions, _ := suggestFriends(ctx, 1, 1, database)
+	if len(suggestions) != 1 || suggestions[0].MutualCount != 2 ||
+		!sameIDs(suggestions[0].MutualFriends, []uint{2, 3}) {
+		t.Errorf("Unexpected top suggestion %+v", suggestions)
+	}
+}
+
+func TestSuggestionsExclusions(t *testing.T) {
+	database := newGraphTestDatabase()
+	database.insertBlock(ctx, BlockUser(6, 1))
+	if ids := getSuggestionIDs(t, database); !sameIDs(ids, []uint{5}) {
+		t.Errorf("Blocked: expected [5], got %v", ids)
+	}
+
+	database = newGraphTestDatabase()
+	database.insertFriendRequest(ctx, FriendRequest{ID: 20, UserFromID: 5, UserToID: 1, Status: StatusPending})
+	if ids := getSuggestionIDs(t, database); !sameIDs(ids, []uint{6}) {
+		t.Errorf("Pending: expected [6], got %v", ids)
+	}
+
+	database = newGraphTestDatabase()
+	recorder := serveTestRequest(MakeTestServer(database), "POST", "/friends/suggestions/5/dismiss", "U1")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Dismiss: expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	if ids := getSuggestionIDs(t, database); !sameIDs(ids, []uint{6}) {
+		t.Errorf("Dismissed: expected [6], got %v", ids)
+	}
+}
+
+func TestSuggestionsHandlerInvalidLimit(t *testing.T) {
+	server := MakeTestServer(newGraphTestDatabase())
+	for _, limit := range []string{"0", "x", "1000"} {
+		recorder := serveTestRequest(server, "GET", "/friends/suggestions?limit="+limit, "U1")
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %v; received %v", limit, http.StatusBadRequest, recorder.Code)
+		}
+	}
+}
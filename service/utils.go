@@ -1,46 +1,385 @@
 package service
 
 import (
+	"context"
+	"crypto/subtle"
 	"database/sql"
 	"errors"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+var (
+	errNoFriendship = errors.New("No friendship found")
+	errNotFollowing = errors.New("Not following")
+	errNoUser       = errors.New("Failed to find user")
 )
 
+// getUserFromHeader returns the user the request's token belongs to, or
+// errNoUser when it belongs to nobody. Failing to look it up is returned as
+// is.
 func getUserFromHeader(req *http.Request, data Database) (uint, error) {
 	key := req.Header.Get("Authorization")
-	user, err := data.redisGetValue(key)
+	user, err := data.redisGetValue(req.Context(), key)
+	if err == errNoValue {
+		return uint(0), errNoUser
+	}
+	if err != nil {
+		return uint(0), err
+	}
+	userID, err := strconv.ParseUint(user, 10, 32)
+	if err != nil || userID == 0 {
+		return uint(0), errNoUser
+	}
+	return uint(userID), nil
+}
+
+// isServiceToken reports whether key is one of the service credentials.
+func isServiceToken(key string, serviceTokens []string) bool {
+	for _, token := range serviceTokens {
+		if key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// getFriendRequestFromVars returns the request named in the route, or
+// sql.ErrNoRows when there is no such request.
+func getFriendRequestFromVars(req *http.Request, database Database) (FriendRequest, error) {
+	key := mux.Vars(req)["request_id"]
+	requestID, err := strconv.ParseUint(key, 10, 32)
 	if err != nil {
-		return uint(0), errors.New("Failed to find user")
+		return FriendRequest{}, sql.ErrNoRows
+	}
+	return database.getFriendRequestByID(req.Context(), uint(requestID))
+}
+
+// getFriendListFromVars returns the list named in the route, provided it
+// belongs to userID. Someone else's list is sql.ErrNoRows, like a missing one.
+func getFriendListFromVars(req *http.Request, userID uint, database Database) (FriendList, error) {
+	key := mux.Vars(req)["list_id"]
+	listID, err := strconv.ParseUint(key, 10, 32)
+	if err != nil {
+		return FriendList{}, sql.ErrNoRows
+	}
+	list, err := database.getFriendList(req.Context(), uint(listID))
+	if err != nil {
+		return FriendList{}, err
+	}
+	if list.UserID != userID {
+		return FriendList{}, sql.ErrNoRows
+	}
+	return list, nil
+}
+
+func getUserIDFromVars(req *http.Request) (uint, error) {
+	key := mux.Vars(req)["user_id"]
+	userID, err := strconv.ParseUint(key, 10, 32)
+	if err != nil || userID == 0 {
+		return uint(0), errors.New("No user id sent")
 	}
-	userID, _ := strconv.ParseUint(user, 10, 32)
 	return uint(userID), nil
 }
 
-func getFriendRequest(userIDFrom, userIDTo uint, database Database) (FriendRequest, error) {
-	request, err := database.getFriendRequestByUserFromAndTo(userIDFrom, userIDTo)
-	if err == nil {
-		return FriendRequest{}, errors.New("No friend request found")
+// endFriendship dissolves the accepted friendship between userID and friendID
+// on behalf of userID. It returns errNoFriendship when they aren't friends.
+func endFriendship(ctx context.Context, userID, friendID uint, database Database) error {
+	request, err := getRequestBetween(ctx, userID, friendID, database)
+	if err == sql.ErrNoRows || (err == nil && request.Status != StatusAccepted) {
+		return errNoFriendship
+	}
+	if err != nil {
+		return err
+	}
+	return unfriend(ctx, request, userID, database)
+}
+
+// unfriend ends the friendship request stands for on behalf of userID and
+// takes each of them out of the other's friend lists and favorites. The notes
+// they kept about each other stay, out of sight until they are friends again,
+// and can still be deleted.
+func unfriend(ctx context.Context, request FriendRequest, userID uint, database Database) error {
+	if err := request.unfriend(userID); err != nil {
+		return err
+	}
+	if err := database.updateFriendRequest(ctx, request); err != nil {
+		return err
+	}
+	friendID := request.friendID(userID)
+	for _, pair := range [][2]uint{{userID, friendID}, {friendID, userID}} {
+		if err := database.removeFromFriendLists(ctx, pair[0], pair[1]); err != nil {
+			return err
+		}
+		if err := database.deleteFavorite(ctx, pair[0], pair[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// severRelationship quietly undoes whatever stands between userID and otherID:
+// a pending request in either direction is cancelled and a friendship or
+// follow is ended on behalf of userID.
+func severRelationship(ctx context.Context, userID, otherID uint, database Database) error {
+	for _, pair := range [][2]uint{{userID, otherID}, {otherID, userID}} {
+		if err := unfollow(ctx, pair[0], pair[1], userID, database); err != nil && err != errNotFollowing {
+			return err
+		}
+	}
+	request, err := getRequestBetween(ctx, userID, otherID, database)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch request.Status {
+	case StatusPending:
+		if err = request.cancel(); err != nil {
+			return err
+		}
+		return database.updateFriendRequest(ctx, request)
+	case StatusAccepted:
+		return unfriend(ctx, request, userID, database)
+	}
+	return nil
+}
+
+// unfollow cancels follower's pending follow request to followee or ends
+// their follow, on behalf of endedBy. It returns errNotFollowing when there is
+// neither.
+func unfollow(ctx context.Context, follower, followee, endedBy uint, database Database) error {
+	request, err := database.getFollowRequest(ctx, follower, followee)
+	if err == sql.ErrNoRows {
+		return errNotFollowing
+	}
+	if err != nil {
+		return err
+	}
+	switch request.Status {
+	case StatusPending:
+		err = request.cancel()
+	case StatusAccepted:
+		err = request.unfriend(endedBy)
+	default:
+		return errNotFollowing
+	}
+	if err != nil {
+		return err
+	}
+	return database.updateFriendRequest(ctx, request)
+}
+
+// getRequestBetween returns the most recent request between the two users,
+// whichever of them sent it, or sql.ErrNoRows when there is none.
+func getRequestBetween(ctx context.Context, userA, userB uint, database Database) (FriendRequest, error) {
+	sent, sentErr := database.getFriendRequestByUserFromAndTo(ctx, userA, userB)
+	received, receivedErr := database.getFriendRequestByUserFromAndTo(ctx, userB, userA)
+	for _, err := range []error{sentErr, receivedErr} {
+		if err != nil && err != sql.ErrNoRows {
+			return FriendRequest{}, err
+		}
+	}
+	switch {
+	case sentErr != nil && receivedErr != nil:
+		return FriendRequest{}, sql.ErrNoRows
+	case sentErr != nil:
+		return received, nil
+	case receivedErr != nil:
+		return sent, nil
+	case received.CreatedAt.After(sent.CreatedAt):
+		return received, nil
 	}
-	return request, nil
+	return sent, nil
 }
 
-func hasFriendRequest(userIDFrom, userIDTo uint, database Database) bool {
-	request, err := getFriendRequest(userIDFrom, userIDTo, database)
-	return request != FriendRequest{} && err == nil
+func hasFriendRequest(ctx context.Context, userIDFrom, userIDTo uint, database Database) (bool, error) {
+	request, err := getRequestBetween(ctx, userIDFrom, userIDTo, database)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil && request.isActive(), err
 }
 
-func conevertRowsToRequests(rows *sql.Rows) []FriendRequest {
+// getSettingsOrDefault returns the user's settings, or the defaults when they
+// never saved any.
+func getSettingsOrDefault(ctx context.Context, userID uint, database Database) (Settings, error) {
+	settings, err := database.getSettings(ctx, userID)
+	if err == sql.ErrNoRows {
+		return defaultSettings(userID), nil
+	}
+	return settings, err
+}
+
+// haveMutualFriend reports whether the two users share at least one friend.
+func haveMutualFriend(ctx context.Context, userA, userB uint, database Database) (bool, error) {
+	graph, err := loadFriendGraph(ctx, []uint{userA, userB}, database)
+	if err != nil {
+		return false, err
+	}
+	return len(graph.mutual(userA, userB)) > 0, nil
+}
+
+// countMutualFriends fills in how many friends userID shares with each of
+// their friends.
+func countMutualFriends(ctx context.Context, userID uint, friends []Friend, database Database) error {
+	ids := []uint{userID}
+	for _, friend := range friends {
+		ids = append(ids, friend.UserID)
+	}
+	graph, err := loadFriendGraph(ctx, ids, database)
+	if err != nil {
+		return err
+	}
+	for i := range friends {
+		friends[i].MutualCount = len(graph.mutual(userID, friends[i].UserID))
+	}
+	return nil
+}
+
+// attachFriendNotes fills in the nicknames and notes userID keeps about each
+// of friends.
+func attachFriendNotes(ctx context.Context, userID uint, friends []Friend, database Database) error {
+	if len(friends) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(friends))
+	for i, friend := range friends {
+		ids[i] = friend.UserID
+	}
+	notes, err := database.getFriendNotes(ctx, userID, ids)
+	if err != nil {
+		return err
+	}
+	byFriend := make(map[uint]FriendNote, len(notes))
+	for _, note := range notes {
+		byFriend[note.FriendID] = note
+	}
+	for i := range friends {
+		note := byFriend[friends[i].UserID]
+		friends[i].Nickname, friends[i].Note = note.Nickname, note.Note
+	}
+	return nil
+}
+
+// favoriteFriends returns userID's favorites as friends, in the order they
+// were marked.
+func favoriteFriends(ctx context.Context, userID uint, favorites []uint, database Database) ([]Friend, error) {
+	friends := []Friend{}
+	if len(favorites) == 0 {
+		return friends, nil
+	}
+	requests, err := database.getRequestsBetween(ctx, userID, favorites)
+	if err != nil {
+		return friends, err
+	}
+	var accepted []FriendRequest
+	for _, request := range requests {
+		if request.Status == StatusAccepted {
+			accepted = append(accepted, request)
+		}
+	}
+	byID := map[uint]Friend{}
+	for _, friend := range friendsFromRequests(userID, accepted) {
+		byID[friend.UserID] = friend
+	}
+	for _, friendID := range favorites {
+		if friend, ok := byID[friendID]; ok {
+			friend.Favorite = true
+			friends = append(friends, friend)
+		}
+	}
+	return friends, nil
+}
+
+func containsID(ids []uint, id uint) bool {
+	for _, each := range ids {
+		if each == id {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsRequestFrom reports whether userTo's settings let userFrom send them
+// a friend request.
+func acceptsRequestFrom(ctx context.Context, userFrom, userTo uint, database Database) (bool, error) {
+	settings, err := getSettingsOrDefault(ctx, userTo, database)
+	if err != nil {
+		return false, err
+	}
+	switch settings.AllowRequestsFrom {
+	case AllowNobody:
+		return false, nil
+	case AllowFriendsOfFriends:
+		return haveMutualFriend(ctx, userFrom, userTo, database)
+	}
+	return true, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanFriendRequest(row rowScanner) (FriendRequest, error) {
+	var request FriendRequest
+	var acceptedAt, rejectedAt, cancelledAt, endedAt pq.NullTime
+	var endedBy sql.NullInt64
+	err := row.Scan(&request.ID, &request.UserFromID, &request.UserToID,
+		&request.Status, &request.CreatedAt, &acceptedAt, &rejectedAt, &cancelledAt,
+		&endedAt, &endedBy, &request.Kind)
+	request.AcceptedAt = acceptedAt.Time
+	request.RejectedAt = rejectedAt.Time
+	request.CancelledAt = cancelledAt.Time
+	request.EndedAt = endedAt.Time
+	request.EndedBy = uint(endedBy.Int64)
+	return request, err
+}
+
+func nullTime(t time.Time) pq.NullTime {
+	return pq.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+func nullUserID(userID uint) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(userID), Valid: userID != 0}
+}
+
+// conevertRowsToRequests reads every request in rows. Failing partway, as
+// when the query runs out of time, fails the whole read rather than returning
+// the requests read so far.
+func conevertRowsToRequests(rows *sql.Rows) ([]FriendRequest, error) {
 	var requests []FriendRequest
 	defer rows.Close()
 	for rows.Next() {
-		var request FriendRequest
-		err := rows.Scan(request.ID,
-			request.UserFromID, request.UserToID, request.CreatedAt,
-			request.AcceptedAt, request.RejectedAt)
-		if err == nil {
-			requests = append(requests, request)
+		request, err := scanFriendRequest(rows)
+		if err != nil {
+			return []FriendRequest{}, err
+		}
+		requests = append(requests, request)
+	}
+	if err := rows.Err(); err != nil {
+		return []FriendRequest{}, err
+	}
+	return requests, nil
+}
+
+// listNameTaken reports whether userID already has a list other than exceptID
+// called name.
+func listNameTaken(ctx context.Context, userID, exceptID uint, name string, database Database) (bool, error) {
+	lists, err := database.getFriendListsByUserID(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, list := range lists {
+		if list.ID != exceptID && strings.EqualFold(list.Name, strings.TrimSpace(name)) {
+			return true, nil
 		}
 	}
-	return requests
+	return false, nil
 }